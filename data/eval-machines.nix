@@ -139,7 +139,11 @@ rec {
             healthChecks
             buildOnly
             substituteOnDestination
+            buildOnTarget
+            revertOnBoot
             tags
+            hooks
+            maintenanceWindow
             ;
           name = n;
           nixosRelease =
@@ -147,7 +151,7 @@ rec {
               or (removeSuffix v.config.system.nixos.version.suffix v.config.system.nixos.version);
           nixConfig = mapAttrs (
             n: v: if builtins.isString v then v else throw "nix option '${n}' must have a string typed value"
-          ) (network'.network.nixConfig or { });
+          ) ((network'.network.nixConfig or { }) // v.config.deployment.nixConfig);
         }
       );
 
@@ -158,6 +162,13 @@ rec {
         meta = {
           description = network.description or "";
           ordering = network.ordering or { };
+          rollout = network.rollout or { };
+          hooks = network.hooks or { };
+          webhooks = network.webhooks or [ ];
+          protectedTags = network.protectedTags or [ ];
+          # only known once the deployment has been evaluated, so it only applies to building and pushing
+          nixBackend = network.nixBackend or "";
+          buildHost = network.buildHost or "";
         };
       };
 
@@ -172,6 +172,94 @@ let
     };
   });
 
+  hookType = types.submodule (_: {
+    options = {
+      description = mkOption {
+        type = str;
+        description = "Hook description";
+        default = "";
+      };
+      cmd = mkOption {
+        type = listOf str;
+        description = "Command to run as list";
+      };
+      remote = mkOption {
+        type = bool;
+        description = ''
+          Whether to run the command on the target host (over SSH), rather than on the machine running morph.
+          Local commands get the host metadata in MORPH_* environment variables.
+        '';
+        default = false;
+      };
+      timeout = mkOption {
+        type = int;
+        description = "Timeout in seconds (0 means no timeout)";
+        default = 0;
+      };
+    };
+  });
+
+  hooksType = submodule (_: {
+    options = {
+      preBuild = mkOption {
+        type = listOf hookType;
+        default = [ ];
+        description = "Hooks to run before building the deployment";
+      };
+      prePush = mkOption {
+        type = listOf hookType;
+        default = [ ];
+        description = "Hooks to run before pushing the configuration to the host";
+      };
+      preActivate = mkOption {
+        type = listOf hookType;
+        default = [ ];
+        description = "Hooks to run before activating the configuration";
+      };
+      postActivate = mkOption {
+        type = listOf hookType;
+        default = [ ];
+        description = "Hooks to run after activating the configuration";
+      };
+      postHealthCheck = mkOption {
+        type = listOf hookType;
+        default = [ ];
+        description = "Hooks to run after the health checks have succeeded";
+      };
+    };
+  });
+
+  maintenanceWindowType = submodule (_: {
+    options = {
+      days = mkOption {
+        type = listOf str;
+        default = [ ];
+        example = [
+          "Mon-Fri"
+          "Sun"
+        ];
+        description = ''
+          Days the window opens on, as day names or ranges of them. Empty means every day.
+        '';
+      };
+      hours = mkOption {
+        type = listOf str;
+        default = [ ];
+        example = [ "22:00-06:00" ];
+        description = ''
+          Times of day the window is open, as HH:MM-HH:MM ranges. A range crossing midnight belongs to the day it
+          starts on. Empty means all day.
+        '';
+      };
+      timezone = mkOption {
+        type = str;
+        default = "UTC";
+        example = "Europe/Copenhagen";
+        description = "Time zone of the days and hours";
+      };
+    };
+  });
+
 in
 {
   options.deployment = {
@@ -212,6 +300,38 @@ in
       '';
     };
 
+    buildOnTarget = mkOption {
+      type = bool;
+      default = false;
+      description = ''
+        Set to true to build the system on the host itself, rather than on the machine running morph.
+        Morph then only copies the derivation of the system (and its dependencies) to the host, and builds it there
+        (substituting what it can) before activating it.
+      '';
+    };
+
+    revertOnBoot = mkOption {
+      type = bool;
+      default = false;
+      description = ''
+        Set to true to re-arm the revert of an activation which `morph deploy --confirm-activation` hasn't confirmed
+        yet when the host boots, since the timer started by morph doesn't survive a reboot. Required for using
+        `--confirm-activation` together with `--reboot`.
+      '';
+    };
+
+    nixConfig = mkOption {
+      type = attrsOf str;
+      default = { };
+      example = {
+        "extra-sandbox-paths" = "/foo/bar";
+      };
+      description = ''
+        Nix options (see `man nix.conf`) for building and pushing the host, in addition to (and overriding) those of
+        `network.nixConfig`. Hosts with different options are built by separate nix invocations.
+      '';
+    };
+
     substituteOnDestination = mkOption {
       type = bool;
       default = false;
@@ -268,6 +388,35 @@ in
         Host tags.
       '';
     };
+
+    maintenanceWindow = mkOption {
+      type = nullOr maintenanceWindowType;
+      default = null;
+      description = ''
+        When the host may be activated or rebooted by `morph deploy`. Outside the window, morph refuses to touch the
+        host, unless `--ignore-maintenance-window` or `--wait-for-maintenance-window` is given.
+      '';
+    };
+
+    hooks = mkOption {
+      type = hooksType;
+      description = ''
+        Commands to run during the phases of a deployment to the host, in addition to those of `network.hooks`.
+      '';
+      default = { };
+    };
+  };
+
+  # Re-arms the revert of an activation that morph hasn't confirmed yet (see `--confirm-activation`),
+  # since the timer started by morph doesn't survive a reboot.
+  config.systemd.services.morph-revert-on-boot = mkIf config.deployment.revertOnBoot {
+    description = "Revert unconfirmed morph activation";
+    wantedBy = [ "multi-user.target" ];
+    unitConfig.ConditionPathExists = "/var/lib/morph/revert.sh";
+    serviceConfig.Type = "oneshot";
+    script = ''
+      ${config.systemd.package}/bin/systemd-run --unit=morph-revert --collect /bin/sh /var/lib/morph/revert.sh after-boot
+    '';
   };
 
   # Creates a txt-file that lists all system healthcheck commands
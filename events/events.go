@@ -0,0 +1,76 @@
+package events
+
+import (
+	"time"
+)
+
+// Kinds of events emitted during a deployment
+const (
+	RunStart   = "run-start"
+	HostStart  = "host-start"
+	Phase      = "phase"
+	HostDone   = "host-done"
+	HostFailed = "host-failed"
+	Summary    = "summary"
+
+	HostsSelected = "hosts-selected"
+	BuildResult   = "build-result"
+	BuildLog      = "build-log"
+	Push          = "push"
+	SecretUpload  = "secret-upload"
+	Activation    = "activation"
+	HealthCheck   = "health-check"
+	Result        = "result"
+	Log           = "log"
+	Error         = "error"
+)
+
+// Status of the step an event reports the outcome of
+const (
+	Succeeded = "succeeded"
+	Failed    = "failed"
+)
+
+type Event struct {
+	Event      string       `json:"event"`
+	Time       time.Time    `json:"time"`
+	Deployment string       `json:"deployment,omitempty"`
+	Action     string       `json:"action,omitempty"`
+	Host       string       `json:"host,omitempty"`
+	Phase      string       `json:"phase,omitempty"`
+	Status     string       `json:"status,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Hosts      []string     `json:"hosts,omitempty"`
+	Results    []HostResult `json:"results,omitempty"`
+	// A store path (e.g. the result of a build, or the system activated on a host), or the destination of a secret
+	Path    string            `json:"path,omitempty"`
+	Paths   []string          `json:"paths,omitempty"`
+	Systems map[string]string `json:"systems,omitempty"`
+	Secret  string            `json:"secret,omitempty"`
+	Check   string            `json:"check,omitempty"`
+	// Seconds the step took
+	Duration float64 `json:"duration,omitempty"`
+	// The result of a command, like the output of --json
+	Data interface{} `json:"data,omitempty"`
+	// A line of human-readable output
+	Message string `json:"message,omitempty"`
+}
+
+// Outcome of a host, as reported in the summary event
+type HostResult struct {
+	Host   string `json:"host"`
+	Status string `json:"status"`
+	Phase  string `json:"phase,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Set the status (and error) of an event reporting the outcome of a step
+func (event Event) Outcome(err error) Event {
+	if err != nil {
+		event.Status = Failed
+		event.Error = err.Error()
+	} else {
+		event.Status = Succeeded
+	}
+	return event
+}
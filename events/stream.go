@@ -0,0 +1,97 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	stream     *json.Encoder
+	listeners  []func(Event)
+	streamLock sync.Mutex
+)
+
+// Write every emitted event to out, as newline-delimited JSON
+func SetStream(out io.Writer) {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+
+	stream = json.NewEncoder(out)
+}
+
+// Whether events are written to a stream (i.e. with --output=json)
+func Streaming() bool {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+
+	return stream != nil
+}
+
+// Call listener with every emitted event. Listeners are called one at a time, and mustn't emit events themselves.
+func Subscribe(listener func(Event)) {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+
+	listeners = append(listeners, listener)
+}
+
+// Write an event to the stream, if any, and pass it to the listeners. Events are written whole, also when emitted
+// concurrently.
+func Emit(event Event) {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	if stream != nil {
+		_ = stream.Encode(event)
+	}
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// Replace os.Stderr with a pipe, passing each line written to it (also by commands run by morph) on as a log event, so
+// the events replace the human-readable output. Returns a function restoring os.Stderr, once the lines written so far
+// have been passed on.
+func CaptureStderr() (restore func(), err error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	original := os.Stderr
+	os.Stderr = writer
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lines := bufio.NewReader(reader)
+		for {
+			line, err := lines.ReadString('\n')
+			if line = strings.TrimRight(line, "\r\n"); line != "" {
+				Emit(Event{Event: Log, Message: line})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		os.Stderr = original
+		writer.Close()
+		// processes left running (e.g. SSH control masters) may keep the pipe open
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}, nil
+}
@@ -0,0 +1,208 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DBCDK/morph/utils"
+)
+
+// Default number of seconds to wait for a webhook to respond
+const defaultWebhookTimeout = 10
+
+type Webhook struct {
+	URL string
+	// Local file holding the key used to sign the payload (HMAC-SHA256). Relative paths are resolved relative to the
+	// deployment file.
+	SecretFile string
+	// Whether a failing webhook should abort the deployment
+	Required bool
+	Timeout  int
+}
+
+// Number of events queued for a webhook that isn't required, before further events are dropped
+const webhookQueueSize = 100
+
+type Webhooks struct {
+	webhooks []Webhook
+	secrets  [][]byte
+	out      io.Writer
+	// events for the webhooks that aren't required, which are delivered in the background (see deliver)
+	queues    []chan queuedEvent
+	delivered sync.WaitGroup
+	closed    bool
+	lock      sync.Mutex
+}
+
+type queuedEvent struct {
+	kind    string
+	payload []byte
+}
+
+// Prepare sending events to webhooks, reading their secrets. Failures of webhooks that aren't required are
+// reported to out.
+func NewWebhooks(webhooks []Webhook, deploymentDir string, out io.Writer) (*Webhooks, error) {
+	secrets := make([][]byte, len(webhooks))
+	for index, webhook := range webhooks {
+		if webhook.URL == "" {
+			return nil, errors.New("webhook is missing a url")
+		}
+		if webhook.SecretFile == "" {
+			continue
+		}
+
+		secret, err := ioutil.ReadFile(utils.GetAbsPathRelativeTo(webhook.SecretFile, deploymentDir))
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read the secret of webhook %s: %s", webhook.URL, err)
+		}
+		secrets[index] = bytes.TrimSpace(secret)
+	}
+
+	w := &Webhooks{
+		webhooks: webhooks,
+		secrets:  secrets,
+		out:      out,
+		queues:   make([]chan queuedEvent, len(webhooks)),
+	}
+	for index, webhook := range webhooks {
+		if webhook.Required {
+			continue
+		}
+		w.queues[index] = make(chan queuedEvent, webhookQueueSize)
+		w.delivered.Add(1)
+		go w.deliver(index)
+	}
+
+	return w, nil
+}
+
+// POST an event to each webhook. Required webhooks are called right away, and an error is returned if any of them
+// failed. Events for the other webhooks are queued, and delivered in the background until Close is called.
+func (w *Webhooks) Send(event Event) error {
+	if len(w.webhooks) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for index, webhook := range w.webhooks {
+		if !webhook.Required {
+			w.enqueue(index, queuedEvent{kind: event.Event, payload: payload})
+			continue
+		}
+
+		err := post(webhook, w.secrets[index], event.Event, payload)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+func (w *Webhooks) enqueue(index int, event queuedEvent) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return
+	}
+	select {
+	case w.queues[index] <- event:
+	default:
+		fmt.Fprintf(w.out, "Warning: webhook %s is behind, dropping the %s event\n", w.webhooks[index].URL, event.kind)
+	}
+}
+
+// Delivers the queued events of a webhook that isn't required. Once it fails, it isn't called again, so an
+// unresponsive webhook can't hold up delivering the remaining events at exit.
+func (w *Webhooks) deliver(index int) {
+	defer w.delivered.Done()
+
+	webhook := w.webhooks[index]
+	failed := false
+	for event := range w.queues[index] {
+		if failed {
+			continue
+		}
+		if err := post(webhook, w.secrets[index], event.kind, event.payload); err != nil {
+			fmt.Fprintf(w.out, "Warning: %s; not sending further events to it\n", err)
+			failed = true
+		}
+	}
+}
+
+// Waits for the queued events to be delivered. Events sent after Close are dropped.
+func (w *Webhooks) Close() {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		for _, queue := range w.queues {
+			if queue != nil {
+				close(queue)
+			}
+		}
+	}
+	w.lock.Unlock()
+
+	w.delivered.Wait()
+}
+
+// Returns the signature of a payload, as sent in the X-Morph-Signature-256 header
+func Signature(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func post(webhook Webhook, secret []byte, kind string, payload []byte) error {
+	timeout := webhook.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	client := &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+	}
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("webhook %s failed: %s", webhook.URL, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "morph")
+	req.Header.Set("X-Morph-Event", kind)
+	if secret != nil {
+		req.Header.Set("X-Morph-Signature-256", Signature(secret, payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook %s failed: %s", webhook.URL, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s failed: got status %s for the %s event", webhook.URL, resp.Status, kind)
+	}
+
+	return nil
+}
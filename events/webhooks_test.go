@@ -0,0 +1,169 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// Starts a local HTTP listener, which records the requests it gets and responds with status
+func listen(t *testing.T, status int) (*httptest.Server, chan request) {
+	requests := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	server, requests := listen(t, http.StatusNoContent)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks, err := NewWebhooks([]Webhook{{URL: server.URL, SecretFile: "secret"}}, dir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := Event{Event: HostDone, Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Host: "web01", Action: "switch"}
+	if err = webhooks.Send(event); err != nil {
+		t.Fatalf("Send failed: %s", err)
+	}
+
+	got := <-requests
+	if kind := got.header.Get("X-Morph-Event"); kind != HostDone {
+		t.Errorf("X-Morph-Event is %q, expected %q", kind, HostDone)
+	}
+	if contentType := got.header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type is %q, expected application/json", contentType)
+	}
+	// the secret is read without the trailing newline
+	if signature := got.header.Get("X-Morph-Signature-256"); signature != Signature([]byte("hunter2"), got.body) {
+		t.Errorf("X-Morph-Signature-256 %q doesn't match the payload", signature)
+	}
+
+	var payload Event
+	if err = json.Unmarshal(got.body, &payload); err != nil {
+		t.Fatalf("Couldn't parse the payload %q: %s", got.body, err)
+	}
+	if !payload.Time.Equal(event.Time) || payload.Event != event.Event || payload.Host != event.Host || payload.Action != event.Action {
+		t.Errorf("Got payload %+v, expected %+v", payload, event)
+	}
+}
+
+func TestWebhookFailures(t *testing.T) {
+	failing, _ := listen(t, http.StatusInternalServerError)
+	succeeding, requests := listen(t, http.StatusOK)
+
+	var out bytes.Buffer
+	webhooks, err := NewWebhooks([]Webhook{{URL: failing.URL}, {URL: succeeding.URL}}, "", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a webhook that isn't required only gives a warning, and the other webhooks still get the event
+	if err = webhooks.Send(Event{Event: RunStart}); err != nil {
+		t.Errorf("Send failed for a webhook that isn't required: %s", err)
+	}
+	webhooks.Close()
+	if !strings.Contains(out.String(), "Warning: webhook "+failing.URL+" failed") {
+		t.Errorf("Expected a warning about the failing webhook, got %q", out.String())
+	}
+	select {
+	case <-requests:
+	default:
+		t.Error("The webhook after the failing one didn't get the event")
+	}
+
+	webhooks, err = NewWebhooks([]Webhook{{URL: failing.URL, Required: true}}, "", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = webhooks.Send(Event{Event: RunStart}); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Expected Send to fail with the status of the required webhook, got %v", err)
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(done) })
+
+	webhooks, err := NewWebhooks([]Webhook{{URL: server.URL, Required: true, Timeout: 1}}, "", ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err = webhooks.Send(Event{Event: RunStart}); err == nil {
+		t.Error("Expected Send to fail when the webhook doesn't respond in time")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send took %s, despite a timeout of 1 second", elapsed)
+	}
+}
+
+func TestOptionalWebhookInBackground(t *testing.T) {
+	done := make(chan struct{})
+	calls := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+		<-done
+	}))
+	t.Cleanup(server.Close)
+
+	webhooks, err := NewWebhooks([]Webhook{{URL: server.URL, Timeout: 1}}, "", ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unresponsive webhook that isn't required doesn't hold up sending events
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err = webhooks.Send(Event{Event: Phase}); err != nil {
+			t.Fatalf("Send failed for a webhook that isn't required: %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Sending to a webhook that isn't required took %s", elapsed)
+	}
+
+	// once it has timed out, it isn't called again
+	webhooks.Close()
+	close(done)
+	if len(calls) != 1 {
+		t.Errorf("The webhook was called %d times after failing, expected 1", len(calls))
+	}
+
+	// events sent after closing are dropped
+	if err = webhooks.Send(Event{Event: Summary}); err != nil {
+		t.Errorf("Send failed after Close: %s", err)
+	}
+}
+
+func TestWebhookWithoutURL(t *testing.T) {
+	if _, err := NewWebhooks([]Webhook{{SecretFile: "secret"}}, "", ioutil.Discard); err == nil {
+		t.Error("Expected a webhook without a url to be rejected")
+	}
+}
@@ -112,3 +112,35 @@ func SortHosts(hosts []nix.Host, ordering nix.HostOrdering) (sortedHosts []nix.H
 
 	return
 }
+
+// Split a list of hosts into rollout waves. Each host ends up in the first wave it has any of the tags of, preserving
+// the original ordering within each wave. Hosts that don't match any wave are added as an additional, last wave.
+func SplitIntoWaves(hosts []nix.Host, waves []nix.RolloutWave) (hostWaves [][]nix.Host) {
+	remainingHosts := hosts
+
+	for _, wave := range waves {
+		var waveHosts, otherHosts []nix.Host
+		for _, host := range remainingHosts {
+			inWave := false
+			for _, tag := range wave.Tags {
+				if hasTag(host, tag) {
+					inWave = true
+					break
+				}
+			}
+
+			if inWave {
+				waveHosts = append(waveHosts, host)
+			} else {
+				otherHosts = append(otherHosts, host)
+			}
+		}
+
+		hostWaves = append(hostWaves, waveHosts)
+		remainingHosts = otherHosts
+	}
+
+	hostWaves = append(hostWaves, remainingHosts)
+
+	return
+}
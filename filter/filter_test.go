@@ -0,0 +1,49 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DBCDK/morph/nix"
+)
+
+func names(waves [][]nix.Host) (result [][]string) {
+	for _, wave := range waves {
+		waveNames := []string{}
+		for _, host := range wave {
+			waveNames = append(waveNames, host.Name)
+		}
+		result = append(result, waveNames)
+	}
+	return
+}
+
+func TestSplitIntoWaves(t *testing.T) {
+	hosts := []nix.Host{
+		{Name: "web01", Tags: []string{"web", "canary"}},
+		{Name: "db01", Tags: []string{"db"}},
+		{Name: "web02", Tags: []string{"web"}},
+		{Name: "misc01"},
+		{Name: "db02", Tags: []string{"db", "canary"}},
+	}
+
+	tests := []struct {
+		name  string
+		waves []nix.RolloutWave
+		want  [][]string
+	}{
+		{"no waves", nil, [][]string{{"web01", "db01", "web02", "misc01", "db02"}}},
+		{"one wave", []nix.RolloutWave{{Tags: []string{"canary"}}}, [][]string{{"web01", "db02"}, {"db01", "web02", "misc01"}}},
+		// hosts end up in the first wave they match
+		{"first match", []nix.RolloutWave{{Tags: []string{"canary"}}, {Tags: []string{"web"}}}, [][]string{{"web01", "db02"}, {"web02"}, {"db01", "misc01"}}},
+		{"any of the tags", []nix.RolloutWave{{Tags: []string{"db", "web"}}}, [][]string{{"web01", "db01", "web02", "db02"}, {"misc01"}}},
+		{"empty wave", []nix.RolloutWave{{Tags: []string{"nothing"}}, {Tags: []string{"db"}}}, [][]string{{}, {"db01", "db02"}, {"web01", "web02", "misc01"}}},
+		{"wave without tags", []nix.RolloutWave{{Tags: []string{"web", "db"}}, {Tags: []string{}}}, [][]string{{"web01", "db01", "web02", "db02"}, {}, {"misc01"}}},
+	}
+
+	for _, test := range tests {
+		if got := names(SplitIntoWaves(hosts, test.waves)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected waves %v, got %v", test.name, test.want, got)
+		}
+	}
+}
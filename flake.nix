@@ -81,5 +81,11 @@
           morph = pkgs.callPackage ./default.nix { inherit version; };
         };
       }
-    );
+    )
+    // {
+      # Evaluates a deployment for `morph deploy .#<name>`, when exposed as the `morph.<name>` output of a flake.
+      # The network must set `network.pkgs` (or `network.lib`, `network.evalConfig` and `network.runCommand`),
+      # since <nixpkgs> isn't available during pure evaluation.
+      lib.deployment = network: import ./data/eval-machines.nix { inherit network; };
+    };
 }
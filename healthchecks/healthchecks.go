@@ -3,24 +3,26 @@ package healthchecks
 import (
 	"errors"
 	"fmt"
+	"github.com/DBCDK/morph/events"
 	"github.com/DBCDK/morph/ssh"
-	"os"
+	"io"
 	"sync"
 	"time"
 )
 
 func PerformChecks(sshContext *ssh.SSHContext, checkName string, host Host, healthChecks HealthChecks, timeout int) (err error) {
-	fmt.Fprintf(os.Stderr, "Running %s on %s (%s):\n", checkName, host.GetName(), host.GetTargetHost())
+	out := sshContext.Stderr()
+	fmt.Fprintf(out, "Running %s on %s (%s):\n", checkName, host.GetName(), host.GetTargetHost())
 
 	wg := sync.WaitGroup{}
 	for _, healthCheck := range healthChecks.Cmd {
 		wg.Add(1)
 		healthCheck.SshContext = sshContext
-		go runCheckUntilSuccess(host, healthCheck, &wg)
+		go runCheckUntilSuccess(out, checkName, host, healthCheck, &wg)
 	}
 	for _, healthCheck := range healthChecks.Http {
 		wg.Add(1)
-		go runCheckUntilSuccess(host, healthCheck, &wg)
+		go runCheckUntilSuccess(out, checkName, host, healthCheck, &wg)
 	}
 
 	doneChan := make(chan bool)
@@ -44,10 +46,10 @@ func PerformChecks(sshContext *ssh.SSHContext, checkName string, host Host, heal
 	for !done {
 		select {
 		case <-doneChan:
-			fmt.Fprintln(os.Stderr, checkName+" OK")
+			fmt.Fprintln(out, checkName+" OK")
 			done = true
 		case <-timeoutChan:
-			fmt.Fprintf(os.Stderr, "Timeout: Gave up waiting for %s to complete after %d seconds\n", checkName, timeout)
+			fmt.Fprintf(out, "Timeout: Gave up waiting for %s to complete after %d seconds\n", checkName, timeout)
 			return errors.New(fmt.Sprintf("timeout running %s on %s", checkName, host.GetName()))
 		}
 	}
@@ -63,14 +65,22 @@ func PerformHealthChecks(sshContext *ssh.SSHContext, host Host, timeout int) (er
 	return PerformChecks(sshContext, "health checks", host, host.GetHealthChecks(), timeout)
 }
 
-func runCheckUntilSuccess(host Host, healthCheck HealthCheck, wg *sync.WaitGroup) {
+func runCheckUntilSuccess(out io.Writer, checkName string, host Host, healthCheck HealthCheck, wg *sync.WaitGroup) {
 	for {
+		start := time.Now()
 		err := healthCheck.Run(host)
+		events.Emit(events.Event{
+			Event:    events.HealthCheck,
+			Host:     host.GetName(),
+			Phase:    checkName,
+			Check:    healthCheck.GetDescription(),
+			Duration: time.Since(start).Seconds(),
+		}.Outcome(err))
 		if err == nil {
-			fmt.Fprintf(os.Stderr, "\t* %s: OK\n", healthCheck.GetDescription())
+			fmt.Fprintf(out, "\t* %s: OK\n", healthCheck.GetDescription())
 			break
 		} else {
-			fmt.Fprintf(os.Stderr, "\t* %s: Failed (%s)\n", healthCheck.GetDescription(), err)
+			fmt.Fprintf(out, "\t* %s: Failed (%s)\n", healthCheck.GetDescription(), err)
 			time.Sleep(time.Duration(healthCheck.GetPeriod()) * time.Second)
 		}
 	}
@@ -0,0 +1,126 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/DBCDK/morph/ssh"
+	"github.com/DBCDK/morph/utils"
+)
+
+// Run the hooks of a phase for a host, one at a time, stopping at the first failing hook.
+// Local hooks get the host metadata along with env in their environment.
+func Run(sshContext *ssh.SSHContext, phase string, host Host, hooks []Hook, env map[string]string) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	out := sshContext.Stderr()
+	fmt.Fprintf(out, "Running %s hooks for %s:\n", phase, host.GetName())
+
+	hostEnv := map[string]string{
+		"MORPH_PHASE":       phase,
+		"MORPH_HOST":        host.GetName(),
+		"MORPH_TARGET_HOST": host.GetTargetHost(),
+		"MORPH_TARGET_USER": host.GetTargetUser(),
+		"MORPH_TAGS":        strings.Join(host.GetTags(), ","),
+	}
+	if host.GetTargetPort() != 0 {
+		hostEnv["MORPH_TARGET_PORT"] = strconv.Itoa(host.GetTargetPort())
+	}
+	for key, value := range env {
+		hostEnv[key] = value
+	}
+
+	for _, hook := range hooks {
+		var err error
+		if hook.Remote {
+			err = runRemote(sshContext, out, host, hook)
+		} else {
+			err = runLocal(out, hook, hostEnv)
+		}
+
+		if err != nil {
+			fmt.Fprintf(out, "\t* %s: Failed\n", hook.GetDescription())
+			return errors.New(fmt.Sprintf("%s hook '%s' failed on %s: %s", phase, hook.GetDescription(), host.GetName(), err))
+		}
+		fmt.Fprintf(out, "\t* %s: OK\n", hook.GetDescription())
+	}
+
+	return nil
+}
+
+// Run the hooks of a phase, which don't belong to any host (i.e. the network wide pre-build hooks)
+func RunLocal(out io.Writer, phase string, hooks []Hook, env map[string]string) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(out, "Running %s hooks:\n", phase)
+
+	phaseEnv := map[string]string{"MORPH_PHASE": phase}
+	for key, value := range env {
+		phaseEnv[key] = value
+	}
+
+	for _, hook := range hooks {
+		if hook.Remote {
+			return errors.New(fmt.Sprintf("%s hook '%s' can't be remote, since it doesn't belong to a host", phase, hook.GetDescription()))
+		}
+
+		err := runLocal(out, hook, phaseEnv)
+		if err != nil {
+			fmt.Fprintf(out, "\t* %s: Failed\n", hook.GetDescription())
+			return errors.New(fmt.Sprintf("%s hook '%s' failed: %s", phase, hook.GetDescription(), err))
+		}
+		fmt.Fprintf(out, "\t* %s: OK\n", hook.GetDescription())
+	}
+
+	return nil
+}
+
+func runLocal(out io.Writer, hook Hook, env map[string]string) error {
+	if len(hook.Cmd) == 0 {
+		return errors.New("no command specified")
+	}
+
+	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), hook.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Cmd[0], hook.Cmd[1:]...)
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	return checkTimeout(ctx, hook, cmd.Run())
+}
+
+func runRemote(sshContext *ssh.SSHContext, out io.Writer, host Host, hook Hook) error {
+	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), hook.Timeout)
+	defer cancel()
+
+	cmd, err := sshContext.CmdContext(ctx, host, hook.Cmd...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	return checkTimeout(ctx, hook, cmd.Run())
+}
+
+func checkTimeout(ctx context.Context, hook Hook, err error) error {
+	if ctx.Err() != nil {
+		return errors.New(fmt.Sprintf("Timeout after %ds", hook.Timeout))
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package hooks
+
+import (
+	"strings"
+)
+
+type Host interface {
+	GetName() string
+	GetTargetHost() string
+	GetTargetPort() int
+	GetTargetUser() string
+	GetTags() []string
+}
+
+// The phases of a deployment hooks can run in
+const (
+	PreBuild        = "pre-build"
+	PrePush         = "pre-push"
+	PreActivate     = "pre-activate"
+	PostActivate    = "post-activate"
+	PostHealthCheck = "post-healthcheck"
+)
+
+type Hooks struct {
+	PreBuild        []Hook
+	PrePush         []Hook
+	PreActivate     []Hook
+	PostActivate    []Hook
+	PostHealthCheck []Hook
+}
+
+type Hook struct {
+	Description string
+	Cmd         []string
+	// Whether the command runs on the target host (over SSH), rather than on the machine running morph
+	Remote  bool
+	Timeout int
+}
+
+// Returns the hooks of a phase
+func (hooks Hooks) Phase(phase string) []Hook {
+	switch phase {
+	case PreBuild:
+		return hooks.PreBuild
+	case PrePush:
+		return hooks.PrePush
+	case PreActivate:
+		return hooks.PreActivate
+	case PostActivate:
+		return hooks.PostActivate
+	case PostHealthCheck:
+		return hooks.PostHealthCheck
+	}
+	return nil
+}
+
+func (hook Hook) GetDescription() string {
+	if hook.Description != "" {
+		return hook.Description
+	}
+	return strings.Join(hook.Cmd, " ")
+}
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/DBCDK/kingpin"
+	"github.com/DBCDK/morph/events"
 	"github.com/DBCDK/morph/filter"
 	"github.com/DBCDK/morph/healthchecks"
+	"github.com/DBCDK/morph/hooks"
 	"github.com/DBCDK/morph/nix"
+	"github.com/DBCDK/morph/report"
 	"github.com/DBCDK/morph/secrets"
 	"github.com/DBCDK/morph/ssh"
 	"github.com/DBCDK/morph/utils"
@@ -21,7 +33,17 @@ import (
 var version string
 var assetRoot string
 
+// The backend selected by network.nixBackend, once the deployment has been evaluated
+var deploymentNixBackend string
+
+// The build host selected by network.buildHost, once the deployment has been evaluated
+var deploymentBuildHost string
+
+// Whether systems built on a build host may stay there, since they're only pushed to the hosts (from the build host)
+var systemsStayOnBuildHost bool
+
 var switchActions = []string{"dry-activate", "test", "switch", "boot"}
+var rollbackSwitchActions = []string{"test", "switch", "boot"}
 
 var (
 	app                 = kingpin.New("morph", "NixOS host manager").Version(version)
@@ -46,6 +68,18 @@ var (
 	deploySwitchAction  string
 	deployUploadSecrets bool
 	deployReboot        bool
+	deployRebootMode    string
+	rebootTimeout       int
+	rebootWaitFor       string
+	rebootSystemdTarget string
+	deployParallel      int
+	keepGoing           bool
+	maxFailures         failureLimit
+	deployRollback      bool
+	deployConfirm       bool
+	deployConfirmWindow int
+	ignoreWindow        bool
+	waitForWindow       bool
 	skipHealthChecks    bool
 	skipPreDeployChecks bool
 	showTrace           bool
@@ -56,15 +90,31 @@ var (
 	attrkey             string
 	execute             = executeCmd(app.Command("exec", "Execute arbitrary commands on machines"))
 	executeCommand      []string
+	rollback            = rollbackCmd(app.Command("rollback", "Activate a previous system generation on machines according to switch-action"))
+	rollbackAction      string
+	rollbackGeneration  int
+	diff                = diffCmd(app.Command("diff", "Build configuration and show how it differs from the configuration running on machines"))
+	deployShowDiff      bool
+	status              = statusCmd(app.Command("status", "Build configuration and compare it with the configuration running on machines"))
+	locks               = locksCmd(app.Command("locks", "List deployment locks held on machines"))
+	forceUnlock         bool
+	confirmProtected    bool
+	reportPath          string
+	testReport          *report.Report
+	history             = historyCmd(app.Command("history", "Show the activations done by morph on machines"))
 	keepGCRoot          = app.Flag("keep-result", "Keep latest build in .gcroots to prevent it from being garbage collected").Default("False").Bool()
+	outputFormat        = app.Flag("output", "Output format; either text on stderr, or newline-delimited JSON events on stdout (json)").Default("text").Enum("text", "json")
+	nixBackend          = app.Flag("nix-backend", "How to run nix: legacy (nix-instantiate, nix-build and nix-copy-closure) or nix (the nix command). Overrides network.nixBackend, which only applies to building and pushing; flake deployments always use nix").Enum(nix.Backends...)
+	buildHost           = app.Flag("build-host", "Build the systems on this machine ([user@]host) over SSH, instead of locally. Overrides network.buildHost").String()
+	copyFromBuildHost   = app.Flag("copy-from-build-host", "Copy the systems built on the build host to this machine, instead of pushing them from the build host to the hosts").Default("False").Bool()
 	allowBuildShell     = app.Flag("allow-build-shell", "Allow using `network.buildShell` to build in a nix-shell which can execute arbitrary commands on the local system").Default("False").Bool()
 )
 
 func deploymentArg(cmd *kingpin.CmdClause) {
-	cmd.Arg("deployment", "File containing the nix deployment expression").
+	cmd.Arg("deployment", "File containing the nix deployment expression, or a flake output (e.g. .#prod for the morph.prod output of the flake in the current directory)").
 		HintFiles("nix").
 		Required().
-		ExistingFileVar(&deployment)
+		StringVar(&deployment)
 }
 
 func attributeArg(cmd *kingpin.CmdClause) {
@@ -136,6 +186,38 @@ func skipHealthChecksFlag(cmd *kingpin.CmdClause) {
 		BoolVar(&skipHealthChecks)
 }
 
+func keepGoingFlag(cmd *kingpin.CmdClause) {
+	cmd.
+		Flag("keep-going", "Continue with the remaining hosts when a host fails, and summarize the failures at the end").
+		Default("False").
+		BoolVar(&keepGoing)
+	cmd.
+		Flag("max-failures", "Like --keep-going, but stop touching additional hosts once this many hosts (e.g. 3) or this percentage of the selected hosts (e.g. 10%) have failed").
+		PlaceHolder("N|N%").
+		SetValue(&maxFailures)
+}
+
+func reportFlag(cmd *kingpin.CmdClause) {
+	cmd.
+		Flag("report", "Write a report with a test suite for each host, and a test case for each phase and health check; as JSON if the file name ends with .json, and as JUnit XML otherwise").
+		PlaceHolder("FILE").
+		StringVar(&reportPath)
+}
+
+func forceUnlockFlag(cmd *kingpin.CmdClause) {
+	cmd.
+		Flag("force-unlock", "Take the deployment lock of hosts, even if another deployment holds it").
+		Default("False").
+		BoolVar(&forceUnlock)
+}
+
+func confirmProtectedFlag(cmd *kingpin.CmdClause) {
+	cmd.
+		Flag("confirm-protected", "Don't ask for confirmation before touching hosts with protected tags (network.protectedTags)").
+		Default("False").
+		BoolVar(&confirmProtected)
+}
+
 func skipPreDeployChecksFlag(cmd *kingpin.CmdClause) {
 	cmd.
 		Flag("skip-pre-deploy-checks", "Whether to skip all pre-deploy checks").
@@ -176,6 +258,7 @@ func buildCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 func pushCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	selectorFlags(cmd)
 	showTraceFlag(cmd)
+	keepGoingFlag(cmd)
 	deploymentArg(cmd)
 	return cmd
 }
@@ -186,6 +269,7 @@ func executeCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	askForSudoPasswdFlag(cmd)
 	getSudoPasswdCommand(cmd)
 	timeoutFlag(cmd)
+	confirmProtectedFlag(cmd)
 	deploymentArg(cmd)
 	cmd.
 		Arg("command", "Command to execute").
@@ -205,14 +289,68 @@ func deployCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	getSudoPasswdCommand(cmd)
 	skipHealthChecksFlag(cmd)
 	skipPreDeployChecksFlag(cmd)
+	keepGoingFlag(cmd)
+	forceUnlockFlag(cmd)
+	confirmProtectedFlag(cmd)
+	reportFlag(cmd)
+	asJsonFlag(cmd)
 	cmd.
 		Flag("upload-secrets", "Upload secrets as part of the host deployment").
 		Default("False").
 		BoolVar(&deployUploadSecrets)
 	cmd.
-		Flag("reboot", "Reboots the host after system activation, but before healthchecks has executed.").
+		Flag("reboot", "Reboots the host after system activation, but before healthchecks has executed. With --reboot=auto, only hosts whose kernel, initrd or kernel parameters changed are rebooted (switch and boot only).").
 		Default("False").
 		BoolVar(&deployReboot)
+	// --reboot=<mode> ends up here (see normalizeArgs)
+	cmd.
+		Flag("reboot-mode", "").
+		Hidden().
+		EnumVar(&deployRebootMode, "always", "auto")
+	cmd.
+		Flag("reboot-timeout", "Seconds to wait for a host to come back after rebooting, before failing it (0 waits forever)").
+		Default("0").
+		IntVar(&rebootTimeout)
+	cmd.
+		Flag("reboot-wait-for", "How to tell that a host is back after rebooting: its boot ID changed (boot-id), it's reachable over SSH again (ssh), or --reboot-systemd-target has been reached after the boot ID changed (systemd-target)").
+		Default(nix.RebootWaitBootID).
+		EnumVar(&rebootWaitFor, nix.RebootWaitBootID, nix.RebootWaitSSH, nix.RebootWaitSystemdTarget)
+	cmd.
+		Flag("reboot-systemd-target", "The systemd target to wait for with --reboot-wait-for=systemd-target").
+		Default("multi-user.target").
+		StringVar(&rebootSystemdTarget)
+	cmd.
+		Flag("show-diff", "Show how the new configuration differs from the running configuration before activating it").
+		Default("False").
+		BoolVar(&deployShowDiff)
+	cmd.
+		Flag("rollback-on-failure", "Reactivate the previous configuration of a host if its health checks fail after activation (switch and test only)").
+		Default("False").
+		BoolVar(&deployRollback)
+	cmd.
+		Flag("confirm-activation", "Start a timer on the host after activation, which reverts to the previous configuration unless morph reconnects and confirms the activation in time (also after --reboot, with deployment.revertOnBoot)").
+		Default("False").
+		BoolVar(&deployConfirm)
+	cmd.
+		Flag("confirm-timeout", "Seconds morph has to confirm an activation (or a reboot), before the host reverts").
+		Default("120").
+		IntVar(&deployConfirmWindow)
+	cmd.
+		Flag("ignore-maintenance-window", "Activate and reboot hosts, even outside their maintenance window").
+		Default("False").
+		BoolVar(&ignoreWindow)
+	cmd.
+		Flag("wait-for-maintenance-window", "Wait for the maintenance window of a host to open, rather than failing the host").
+		Default("False").
+		BoolVar(&waitForWindow)
+	cmd.
+		Flag("parallel", "Deploy to this many hosts at a time. Hosts are deployed in batches, and no new batch is started if a host in the previous batch failed its checks (alias: --batch-size)").
+		Default("1").
+		IntVar(&deployParallel)
+	cmd.
+		Flag("batch-size", "Alias for --parallel").
+		Hidden().
+		IntVar(&deployParallel)
 	cmd.
 		Arg("switch-action", "Either of "+strings.Join(switchActions, "|")).
 		Required().
@@ -221,20 +359,79 @@ func deployCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	return cmd
 }
 
+func rollbackCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	deploymentArg(cmd)
+	timeoutFlag(cmd)
+	askForSudoPasswdFlag(cmd)
+	getSudoPasswdCommand(cmd)
+	skipHealthChecksFlag(cmd)
+	forceUnlockFlag(cmd)
+	confirmProtectedFlag(cmd)
+	cmd.
+		Flag("generation", "System profile generation to roll back to (default: the generation before the current one)").
+		Default("0").
+		IntVar(&rollbackGeneration)
+	cmd.
+		Arg("switch-action", "Either of "+strings.Join(rollbackSwitchActions, "|")).
+		Required().
+		HintOptions(rollbackSwitchActions...).
+		EnumVar(&rollbackAction, rollbackSwitchActions...)
+	return cmd
+}
+
+func diffCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	nixBuildArgFlag(cmd)
+	deploymentArg(cmd)
+	return cmd
+}
+
+func statusCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	nixBuildArgFlag(cmd)
+	deploymentArg(cmd)
+	asJsonFlag(cmd)
+	return cmd
+}
+
+func locksCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	deploymentArg(cmd)
+	asJsonFlag(cmd)
+	return cmd
+}
+
+func historyCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	deploymentArg(cmd)
+	asJsonFlag(cmd)
+	return cmd
+}
+
 func healthCheckCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	selectorFlags(cmd)
 	showTraceFlag(cmd)
 	deploymentArg(cmd)
 	timeoutFlag(cmd)
+	reportFlag(cmd)
 	return cmd
 }
 
 func uploadSecretsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	selectorFlags(cmd)
 	showTraceFlag(cmd)
+	keepGoingFlag(cmd)
 	askForSudoPasswdFlag(cmd)
 	getSudoPasswdCommand(cmd)
 	skipHealthChecksFlag(cmd)
+	reportFlag(cmd)
+	confirmProtectedFlag(cmd)
 	deploymentArg(cmd)
 	return cmd
 }
@@ -259,13 +456,42 @@ func setup() {
 
 func main() {
 
-	clause := kingpin.MustParse(app.Parse(os.Args[1:]))
+	clause := kingpin.MustParse(app.Parse(normalizeArgs(os.Args[1:])))
+
+	if _, isFlake := nix.ParseFlake(deployment); deployment != "" && !isFlake {
+		if _, err := os.Stat(deployment); err != nil {
+			app.Fatalf("path '%s' does not exist", deployment)
+		}
+	} else if isFlake && *nixBackend == nix.LegacyBackend {
+		app.Fatalf("flake deployments can't use the legacy nix backend")
+	}
 
 	//TODO: Remove deprecation warning when removing --build-arg flag
 	if len(nixBuildArg) > 0 {
 		fmt.Fprintln(os.Stderr, "Deprecation: The --build-arg flag will be removed in a future release.")
 	}
 
+	// the systems are only needed locally for building, diffing and showing the diff before deploying
+	systemsStayOnBuildHost = clause == push.FullCommand() || clause == status.FullCommand() ||
+		(clause == deploy.FullCommand() && !deployShowDiff)
+
+	if *outputFormat == "json" {
+		events.SetStream(os.Stdout)
+		restoreStderr, err := events.CaptureStderr()
+		handleError(err)
+		utils.AddFinalizer(restoreStderr)
+	}
+
+	if reportPath != "" {
+		testReport = report.New()
+		events.Subscribe(testReport.Handle)
+		utils.AddFinalizer(func() {
+			if err := testReport.WriteFile(reportPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't write report: %s\n", err)
+			}
+		})
+	}
+
 	defer utils.RunFinalizers()
 	setup()
 
@@ -278,37 +504,115 @@ func main() {
 	}
 
 	// setup hosts
-	hosts, err := getHosts(deployment)
+	hosts, meta, err := getHosts()
 	handleError(err)
 
+	switch clause {
+	case deploy.FullCommand():
+		if *dryRun {
+			break
+		}
+		fallthrough
+	case execute.FullCommand(), uploadSecrets.FullCommand(), rollback.FullCommand():
+		err = confirmProtectedHosts(hosts, meta.ProtectedTags)
+		handleError(err)
+	}
+
 	switch clause {
 	case build.FullCommand():
 		_, err = execBuild(hosts)
 	case push.FullCommand():
 		_, err = execPush(hosts)
 	case deploy.FullCommand():
-		_, err = execDeploy(hosts)
+		_, err = execDeploy(hosts, meta)
 	case healthCheck.FullCommand():
 		err = execHealthCheck(hosts)
 	case uploadSecrets.FullCommand():
 		err = execUploadSecrets(createSSHContext(), hosts, nil)
 	case listSecrets.FullCommand():
-		if asJson {
+		if asJson || events.Streaming() {
 			err = execListSecretsAsJson(hosts)
 		} else {
 			execListSecrets(hosts)
 		}
 	case execute.FullCommand():
 		err = execExecute(hosts)
+	case rollback.FullCommand():
+		err = execRollback(hosts)
+	case status.FullCommand():
+		err = execStatus(hosts)
+	case diff.FullCommand():
+		err = execDiff(hosts)
+	case locks.FullCommand():
+		err = execLocks(hosts)
+	case history.FullCommand():
+		err = execHistory(hosts)
 	}
 
 	handleError(err)
 }
 
+// Boolean kingpin flags can't take a value, so --reboot=<mode> and --reboot <mode> are passed on as --reboot-mode=<mode>,
+// while --reboot=true and --reboot=false are passed on as the plain boolean flag. Only the flags of the deploy command
+// are rewritten, up to a "--".
+func normalizeArgs(args []string) []string {
+	command := commandIndex(args)
+	if command < 0 || args[command] != deploy.FullCommand() {
+		return args
+	}
+
+	normalized := append(make([]string, 0, len(args)), args[:command+1]...)
+	for index := command + 1; index < len(args); index++ {
+		arg := args[index]
+		if arg == "--" {
+			return append(normalized, args[index:]...)
+		}
+		if arg == "--reboot" && index+1 < len(args) && isRebootMode(args[index+1]) {
+			index++
+			arg = "--reboot=" + args[index]
+		}
+		if mode, ok := strings.CutPrefix(arg, "--reboot="); ok {
+			switch mode {
+			case "true":
+				arg = "--reboot"
+			case "false":
+				arg = "--no-reboot"
+			default:
+				arg = "--reboot-mode=" + mode
+			}
+		}
+		normalized = append(normalized, arg)
+	}
+	return normalized
+}
+
+// Returns the index of the command in args, skipping the global flags (and their values) before it, or -1
+func commandIndex(args []string) int {
+	for index := 0; index < len(args); index++ {
+		arg := args[index]
+		if arg == "--" {
+			return -1
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return index
+		}
+		name, _, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if flag := app.GetFlag(name); flag != nil && !hasValue && !flag.Model().IsBoolFlag() {
+			index++
+		}
+	}
+	return -1
+}
+
+func isRebootMode(mode string) bool {
+	return mode == "always" || mode == "auto"
+}
+
 func handleError(err error) {
 	//Stupid handling of catch-all errors for now
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		events.Emit(events.Event{Event: events.Error, Error: err.Error()})
 		utils.Exit(1)
 	}
 }
@@ -338,10 +642,9 @@ func execBuild(hosts []nix.Host) (string, error) {
 }
 
 func execEval() (string, error) {
-	ctx := getNixContext()
+	ctx := getNixContext(createSSHContext())
 
-	deploymentFile, err := os.Open(deployment)
-	deploymentPath, err := filepath.Abs(deploymentFile.Name())
+	deploymentPath, err := absDeployment()
 	if err != nil {
 		return "", err
 	}
@@ -358,10 +661,34 @@ func execPush(hosts []nix.Host) (string, error) {
 	}
 
 	fmt.Fprintln(os.Stderr)
-	return resultPath, pushPaths(createSSHContext(), hosts, resultPath)
+
+	sshContext := createSSHContext()
+	results := newHostResults(hosts)
+	for _, host := range hosts {
+		if host.BuildOnly {
+			fmt.Fprintf(os.Stderr, "Push is disabled for build-only host: %s\n", host.Name)
+			results.skipped(host.Name, "build-only")
+			continue
+		}
+
+		err = pushPaths(sshContext, []nix.Host{host}, resultPath)
+		if err != nil {
+			results.failed(host.Name, &phaseError{Phase: phasePush, Err: err})
+			if results.exhausted() {
+				break
+			}
+			if results.keepGoing() {
+				continue
+			}
+			return "", err
+		}
+		results.succeeded(host.Name)
+	}
+
+	return resultPath, results.finish()
 }
 
-func execDeploy(hosts []nix.Host) (string, error) {
+func execDeploy(hosts []nix.Host, meta nix.DeploymentMetadata) (string, error) {
 	doPush := false
 	doUploadSecrets := false
 	doActivate := false
@@ -382,94 +709,1492 @@ func execDeploy(hosts []nix.Host) (string, error) {
 		}
 	}
 
-	resultPath, err := buildHosts(hosts)
+	if deployRollback && deploySwitchAction != "switch" && deploySwitchAction != "test" {
+		return "", errors.New("--rollback-on-failure is only supported for the switch and test actions")
+	}
+	if deployConfirm && deploySwitchAction == "dry-activate" {
+		return "", errors.New("--confirm-activation is not supported for dry-activate")
+	}
+	if deployRebootMode == "always" {
+		deployReboot = true
+	}
+	rebootAuto := deployRebootMode == "auto" && !deployReboot
+	if rebootAuto && deploySwitchAction != "switch" && deploySwitchAction != "boot" {
+		return "", errors.New("--reboot=auto is only supported for the switch and boot actions")
+	}
+	if deployConfirm && (deployReboot || rebootAuto) {
+		for _, host := range hosts {
+			if !host.RevertOnBoot && !host.BuildOnly {
+				return "", fmt.Errorf("%s: --confirm-activation with --reboot requires deployment.revertOnBoot, for the revert to survive the reboot", host.Name)
+			}
+		}
+	}
+
+	for _, host := range hosts {
+		if host.MaintenanceWindow == nil {
+			continue
+		}
+		if err := host.MaintenanceWindow.Validate(); err != nil {
+			return "", fmt.Errorf("%s: %s", host.Name, err)
+		}
+	}
+
+	// nothing is deployed with --dry-run, so there's nothing to notify about
+	configuredWebhooks := meta.Webhooks
+	if *dryRun {
+		configuredWebhooks = nil
+	}
+	webhooks, err := events.NewWebhooks(configuredWebhooks, deploymentDirectory(), os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	// deliver the queued events, also when morph exits early (e.g. after a failed health check)
+	defer webhooks.Close()
+	utils.AddFinalizer(webhooks.Close)
+
+	deploymentPath, err := absDeployment()
+	if err != nil {
+		return "", err
+	}
+
+	notify := func(event events.Event) error {
+		event.Time = time.Now().UTC()
+		event.Deployment = deploymentPath
+		event.Action = deploySwitchAction
+		events.Emit(event)
+		return webhooks.Send(event)
+	}
+
+	// Notify about a host entering a phase, failing the host (in that phase) if a required webhook fails
+	enterPhase := func(host nix.Host, phase string) error {
+		err := notify(events.Event{Event: events.Phase, Host: host.Name, Phase: phase})
+		if err != nil {
+			return &phaseError{Phase: phase, Err: err}
+		}
+		return nil
+	}
+
+	hostNames := make([]string, 0)
+	for _, host := range hosts {
+		hostNames = append(hostNames, host.Name)
+	}
+	err = notify(events.Event{Event: events.RunStart, Hosts: hostNames})
 	if err != nil {
 		return "", err
 	}
 
+	results := newHostResults(hosts)
+
+	var summaryOnce sync.Once
+	sendSummary := func() (err error) {
+		summaryOnce.Do(func() {
+			err = notify(events.Event{Event: events.Summary, Results: results.summary()})
+		})
+		return err
+	}
+
+	// Fail every host in a phase before the hosts are deployed, sending the summary
+	failAll := func(phase string, err error) error {
+		for _, host := range hosts {
+			results.failed(host.Name, &phaseError{Phase: phase, Err: err})
+		}
+		_ = sendSummary()
+		return err
+	}
+
+	if !*dryRun {
+		err := runPreBuildHooks(hosts, meta)
+		if err != nil {
+			return "", failAll(phasePreBuildHooks, err)
+		}
+	}
+
+	// with --json, stdout is reserved for the dry-activate summary
+	build := buildHosts
+	if asJson {
+		build = realiseHosts
+	}
+
+	resultPath, err := build(hosts)
+	if err != nil {
+		return "", failAll(phaseBuild, err)
+	}
+
 	fmt.Fprintln(os.Stderr)
 
 	sshContext := createSSHContext()
 
-	for _, host := range hosts {
+	unitChanges := make(map[string]nix.UnitChanges)
+	unitChangesLock := sync.Mutex{}
+
+	// with --reboot=auto, what changed on each host, requiring a reboot
+	rebootReasons := make(map[string][]string)
+	rebootReasonsLock := sync.Mutex{}
+
+	deployHost := func(sshContext *ssh.SSHContext, host nix.Host) error {
+		out := sshContext.Stderr()
+
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Deployment steps are disabled for build-only host: %s\n", host.Name)
-			continue
+			fmt.Fprintf(out, "Deployment steps are disabled for build-only host: %s\n", host.Name)
+			return nil
 		}
 
 		singleHostInList := []nix.Host{host}
 
+		if doPush || doActivate {
+			if err := enterPhase(host, phaseLock); err != nil {
+				return err
+			}
+			err := lockHost(sshContext, &host)
+			if err != nil {
+				return &phaseError{Phase: phaseLock, Err: err}
+			}
+		}
+
+		if deployShowDiff {
+			if err := enterPhase(host, phaseDiff); err != nil {
+				return err
+			}
+			err := showDiff(sshContext, host, resultPath)
+			if err != nil {
+				return &phaseError{Phase: phaseDiff, Err: err}
+			}
+			fmt.Fprintln(out)
+		}
+
 		if doPush {
+			if err := enterPhase(host, phasePush); err != nil {
+				return err
+			}
+			err := runHooks(sshContext, hooks.PrePush, &host, meta, resultPath)
+			if err != nil {
+				return err
+			}
+
 			err = pushPaths(sshContext, singleHostInList, resultPath)
 			if err != nil {
-				return "", err
+				return &phaseError{Phase: phasePush, Err: err}
+			}
+		}
+		fmt.Fprintln(out)
+
+		// dry-activate doesn't change anything, so there's no need for e.g. taking the host out of a load balancer
+		runActivationHooks := doActivate && deploySwitchAction != "dry-activate"
+		// secret upload actions may restart services, so the window is awaited before the secrets are uploaded
+		if runActivationHooks && host.MaintenanceWindow != nil {
+			if err := enterPhase(host, phaseMaintenance); err != nil {
+				return err
+			}
+			err := awaitMaintenanceWindow(out, host, "activate")
+			if err != nil {
+				return &phaseError{Phase: phaseMaintenance, Err: err}
 			}
 		}
-		fmt.Fprintln(os.Stderr)
 
 		if doUploadSecrets {
+			if err := enterPhase(host, phaseSecrets); err != nil {
+				return err
+			}
 			phase := "pre-activation"
-			err = execUploadSecrets(sshContext, singleHostInList, &phase)
+			err := uploadSecretsToHost(sshContext, host, &phase)
 			if err != nil {
-				return "", err
+				return err
 			}
 
-			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(out)
 		}
 
 		if !skipPreDeployChecks {
+			if err := enterPhase(host, phasePreDeployChecks); err != nil {
+				return err
+			}
 			err := healthchecks.PerformPreDeployChecks(sshContext, &host, timeout)
 			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not deploying to additional hosts, since a host pre-deploy check failed.")
-				utils.Exit(1)
+				return &phaseError{Phase: phasePreDeployChecks, Err: err}
 			}
 		}
 
-		if doActivate {
-			err = activateConfiguration(sshContext, singleHostInList, resultPath)
+		if runActivationHooks {
+			err := runHooks(sshContext, hooks.PreActivate, &host, meta, resultPath)
 			if err != nil {
-				return "", err
+				return err
+			}
+		}
+
+		if doActivate {
+			if err := enterPhase(host, phaseActivation); err != nil {
+				return err
 			}
 		}
 
-		if deployReboot {
-			err = host.Reboot(sshContext)
+		var previous *previousSystem
+		if doActivate && (deployRollback || deployConfirm) {
+			var err error
+			previous, err = recordPreviousSystem(sshContext, &host)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, "Reboot failed")
-				return "", err
+				return &phaseError{Phase: phaseActivation, Err: err}
 			}
 		}
 
-		if doUploadSecrets {
-			phase := "post-activation"
-			err = execUploadSecrets(sshContext, singleHostInList, &phase)
+		confirm := doActivate && deployConfirm
+		var confirmDeadline time.Time
+
+		if doActivate && deploySwitchAction == "dry-activate" {
+			// capture the output of switch-to-configuration, while still showing it
+			var output bytes.Buffer
+			err := activateConfiguration(sshContext.WithOutput(io.MultiWriter(out, &output)), singleHostInList, resultPath)
 			if err != nil {
-				return "", err
+				return &phaseError{Phase: phaseActivation, Err: err}
 			}
 
-			fmt.Fprintln(os.Stderr)
+			unitChangesLock.Lock()
+			unitChanges[host.Name] = nix.ParseDryActivation(output.String())
+			unitChangesLock.Unlock()
+		} else if confirm {
+			// the revert timer is started together with the activation on the host, so it's armed even if the
+			// activation cuts morph off. A failed activation is reverted as well.
+			err := activateWithRevert(sshContext, host, resultPath, ssh.Revert{
+				Configuration: previous.Path,
+				Generation:    previous.Generation,
+				Action:        deploySwitchAction,
+				Timeout:       deployConfirmWindow,
+			})
+			confirmDeadline = time.Now().Add(time.Duration(deployConfirmWindow) * time.Second)
+			if err != nil {
+				fmt.Fprintf(out, "The activation won't be confirmed, so %s will revert to the previous configuration\n", host.Name)
+				return &phaseError{Phase: phaseActivation, Err: err}
+			}
+			fmt.Fprintf(out, "%s will revert to the previous configuration, unless the activation is confirmed within %d seconds\n", host.Name, deployConfirmWindow)
+		} else if doActivate {
+			err := activateConfiguration(sshContext, singleHostInList, resultPath)
+			if err != nil {
+				return &phaseError{Phase: phaseActivation, Err: err}
+			}
 		}
 
-		if !skipHealthChecks {
-			err := healthchecks.PerformHealthChecks(sshContext, &host, timeout)
+		reboot := deployReboot
+		if rebootAuto && doActivate {
+			configuration, err := nix.GetNixSystemPath(host, resultPath)
 			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not deploying to additional hosts, since a host health check failed.")
-				utils.Exit(1)
+				return &phaseError{Phase: phaseReboot, Err: err}
+			}
+			reasons, err := sshContext.RebootReasons(&host, configuration)
+			if err != nil {
+				return &phaseError{Phase: phaseReboot, Err: err}
 			}
-		}
 
-		fmt.Fprintln(os.Stderr, "Done:", host.Name)
-	}
+			rebootReasonsLock.Lock()
+			rebootReasons[host.Name] = reasons
+			rebootReasonsLock.Unlock()
 
-	return resultPath, nil
-}
+			reboot = len(reasons) > 0
+			if reboot {
+				fmt.Fprintf(out, "%s needs a reboot, since its %s changed\n", host.Name, strings.Join(reasons, ", "))
+			} else {
+				fmt.Fprintf(out, "%s doesn't need a reboot\n", host.Name)
+			}
+		}
 
-func createSSHContext() *ssh.SSHContext {
-	return &ssh.SSHContext{
-		AskForSudoPassword:     askForSudoPasswd,
-		GetSudoPasswordCommand: passCmd,
+		// the window may have closed during activation
+		if reboot && host.MaintenanceWindow != nil {
+			if err := enterPhase(host, phaseMaintenance); err != nil {
+				return err
+			}
+			err := awaitMaintenanceWindow(out, host, "reboot")
+			if err != nil {
+				return &phaseError{Phase: phaseMaintenance, Err: err}
+			}
+		}
+
+		if reboot {
+			if err := enterPhase(host, phaseReboot); err != nil {
+				return err
+			}
+			rebootOptions := nix.RebootOptions{
+				Timeout:       time.Duration(rebootTimeout) * time.Second,
+				WaitFor:       rebootWaitFor,
+				SystemdTarget: rebootSystemdTarget,
+			}
+			// after switch and boot, the host must boot into the new configuration
+			if doActivate && (deploySwitchAction == "switch" || deploySwitchAction == "boot") {
+				expectedSystem, err := nix.GetNixSystemPath(host, resultPath)
+				if err != nil {
+					return &phaseError{Phase: phaseReboot, Err: err}
+				}
+				rebootOptions.ExpectedSystem = expectedSystem
+			}
+			err := host.Reboot(sshContext, rebootOptions)
+			if err != nil {
+				fmt.Fprintln(out, "Reboot failed")
+				return &phaseError{Phase: phaseReboot, Err: err}
+			}
+			// the revert timer starts over when the host boots
+			confirmDeadline = time.Now().Add(time.Duration(deployConfirmWindow) * time.Second)
+		}
+
+		if confirm {
+			if err := enterPhase(host, phaseConfirmation); err != nil {
+				return err
+			}
+			err := sshContext.ConfirmActivation(&host, confirmDeadline)
+			if err != nil {
+				return &phaseError{Phase: phaseConfirmation, Err: err}
+			}
+		}
+
+		if runActivationHooks {
+			err := runHooks(sshContext, hooks.PostActivate, &host, meta, resultPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the activation is recorded once the health checks are done, so a rollback is recorded after it
+		recordDeploy := func() error {
+			if !doActivate || deploySwitchAction == "dry-activate" {
+				return nil
+			}
+			configuration, err := nix.GetNixSystemPath(host, resultPath)
+			if err != nil {
+				return &phaseError{Phase: phaseActivation, Err: err}
+			}
+			recordActivation(sshContext, &host, configuration, deploySwitchAction, "deploy")
+			return nil
+		}
+
+		// every failed health check after the activation, including those after uploading secrets, ends up here
+		healthChecksFailed := func(err error) error {
+			if recordErr := recordDeploy(); recordErr != nil {
+				return recordErr
+			}
+			if deployRollback && previous != nil {
+				rollbackErr := previous.reactivate(sshContext, &host)
+				if rollbackErr != nil {
+					fmt.Fprintf(out, "Rollback of %s failed: %s\n", host.Name, rollbackErr)
+				} else {
+					recordActivation(sshContext, &host, previous.Path, deploySwitchAction, "rollback-on-failure")
+				}
+			}
+			return err
+		}
+
+		if doUploadSecrets {
+			if err := enterPhase(host, phaseSecrets); err != nil {
+				return err
+			}
+			phase := "post-activation"
+			err := uploadSecretsToHost(sshContext, host, &phase)
+			var phaseErr *phaseError
+			if errors.As(err, &phaseErr) && phaseErr.Phase == phaseHealthChecks {
+				return healthChecksFailed(err)
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(out)
+		}
+
+		if !skipHealthChecks {
+			if err := enterPhase(host, phaseHealthChecks); err != nil {
+				return err
+			}
+			err := healthchecks.PerformHealthChecks(sshContext, &host, timeout)
+			if err != nil {
+				return healthChecksFailed(&phaseError{Phase: phaseHealthChecks, Err: err})
+			}
+		}
+
+		if err := recordDeploy(); err != nil {
+			return err
+		}
+
+		if runActivationHooks {
+			err := runHooks(sshContext, hooks.PostHealthCheck, &host, meta, resultPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintln(out, "Done:", host.Name)
+		return nil
+	}
+
+	// Wraps deployHost, notifying about the start and outcome of each host
+	notifyingDeployHost := func(sshContext *ssh.SSHContext, host nix.Host) error {
+		sshContext, err := captureOutput(sshContext, host)
+		if err != nil {
+			return err
+		}
+
+		err = notify(events.Event{Event: events.HostStart, Host: host.Name})
+		if err != nil {
+			return err
+		}
+
+		err = deployHost(sshContext, host)
+		if err != nil {
+			event := events.Event{Event: events.HostFailed, Host: host.Name, Error: err.Error()}
+			var phaseErr *phaseError
+			if errors.As(err, &phaseErr) {
+				event.Phase = phaseErr.Phase
+			}
+			// the host has failed already, so a failing webhook doesn't change the outcome
+			_ = notify(event)
+			return err
+		}
+
+		return notify(events.Event{Event: events.HostDone, Host: host.Name})
+	}
+
+	waves := filter.SplitIntoWaves(hosts, meta.Rollout.Waves)
+	for waveIndex, wave := range waves {
+		if len(wave) == 0 {
+			continue
+		}
+		if results.exhausted() {
+			break
+		}
+
+		if len(meta.Rollout.Waves) > 0 {
+			fmt.Fprintf(os.Stderr, "Rollout wave %d/%d (%s): %d hosts\n", waveIndex+1, len(waves), waveDescription(meta.Rollout.Waves, waveIndex), len(wave))
+			fmt.Fprintln(os.Stderr)
+		}
+
+		failedBefore := results.failedCount()
+		for _, batch := range batchHosts(wave, deployParallel) {
+			// the hosts of a batch start at the same time, so the budget can only be checked between batches
+			if results.exhausted() {
+				break
+			}
+
+			errs, err := runBatch(sshContext, batch, notifyingDeployHost)
+			if err != nil {
+				_ = sendSummary()
+				return "", err
+			}
+
+			// The whole batch is allowed to finish, before deciding whether to continue with the next one
+			var firstErr error
+			for index, err := range errs {
+				host := batch[index]
+				if err == nil {
+					if host.BuildOnly {
+						results.skipped(host.Name, "build-only")
+					} else {
+						results.succeeded(host.Name)
+					}
+					continue
+				}
+
+				results.failed(host.Name, err)
+				if results.keepGoing() {
+					continue
+				}
+
+				var phaseErr *phaseError
+				if errors.As(err, &phaseErr) && phaseErr.isCheck() {
+					fmt.Fprintln(os.Stderr)
+					if phaseErr.Phase == phasePreDeployChecks {
+						fmt.Fprintln(os.Stderr, "Not deploying to additional hosts, since a host pre-deploy check failed.")
+					} else {
+						fmt.Fprintln(os.Stderr, "Not deploying to additional hosts, since a host health check failed.")
+					}
+					_ = sendSummary()
+					utils.Exit(1)
+				}
+
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+
+			if firstErr != nil {
+				_ = sendSummary()
+				return "", firstErr
+			}
+		}
+
+		// Later waves are only deployed, when every host in this wave succeeded, regardless of --keep-going
+		if results.failedCount() > failedBefore && hasHosts(waves[waveIndex+1:]) {
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr, "Not continuing with the next rollout wave, since a host in this wave failed.")
+			break
+		}
+
+		if doActivate && waveIndex < len(meta.Rollout.Waves) && meta.Rollout.Waves[waveIndex].Pause > 0 && hasHosts(waves[waveIndex+1:]) {
+			pause := meta.Rollout.Waves[waveIndex].Pause
+			fmt.Fprintf(os.Stderr, "Waiting %d seconds before the next rollout wave..\n", pause)
+			fmt.Fprintln(os.Stderr)
+			time.Sleep(time.Duration(pause) * time.Second)
+		}
+	}
+
+	if doActivate && deploySwitchAction == "dry-activate" {
+		err = printUnitChanges(hosts, unitChanges)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if rebootAuto && doActivate {
+		printRebootSummary(hosts, rebootReasons)
+	}
+
+	if err = sendSummary(); err != nil {
+		return "", err
+	}
+
+	if err = results.finish(); err != nil {
+		return "", err
+	}
+
+	return resultPath, nil
+}
+
+// Summarize which hosts --reboot=auto rebooted, and why
+func printRebootSummary(hosts []nix.Host, rebootReasons map[string][]string) {
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Reboots:")
+	for _, host := range hosts {
+		reasons, ok := rebootReasons[host.Name]
+		switch {
+		case !ok:
+			continue
+		case len(reasons) > 0:
+			fmt.Fprintf(os.Stderr, "\t%s: rebooted (changed: %s)\n", host.Name, strings.Join(reasons, ", "))
+		default:
+			fmt.Fprintf(os.Stderr, "\t%s: not needed\n", host.Name)
+		}
+	}
+}
+
+// Print the result of a command as JSON on stdout, or as a result event with --output=json
+func printJson(value interface{}) error {
+	if events.Streaming() {
+		events.Emit(events.Event{Event: events.Result, Data: value})
+		return nil
+	}
+
+	jsonValue, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", jsonValue)
+	return nil
+}
+
+// Summarize the unit changes dry-activate found, as a table on stderr or as JSON on stdout
+func printUnitChanges(hosts []nix.Host, unitChanges map[string]nix.UnitChanges) error {
+	if asJson || events.Streaming() {
+		return printJson(unitChanges)
+	}
+
+	hostNames := make([]string, 0)
+	for _, host := range hosts {
+		hostNames = append(hostNames, host.Name)
+	}
+
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Unit changes:")
+	nix.PrintUnitChanges(os.Stderr, hostNames, unitChanges)
+
+	return nil
+}
+
+// Returns an error if the maintenance window of the host is closed, unless --ignore-maintenance-window is given, or
+// waits for it to open with --wait-for-maintenance-window
+func awaitMaintenanceWindow(out io.Writer, host nix.Host, action string) error {
+	window := host.MaintenanceWindow
+	now := time.Now()
+	open, err := window.Contains(now)
+	if err != nil || open {
+		return err
+	}
+
+	if ignoreWindow {
+		fmt.Fprintf(out, "Warning: %s is outside its maintenance window (%s)\n", host.Name, window)
+		return nil
+	}
+
+	next, err := window.NextOpening(now)
+	if err != nil {
+		return err
+	}
+
+	if !waitForWindow {
+		return fmt.Errorf("Refusing to %s %s outside its maintenance window (%s), which opens at %s. Use --wait-for-maintenance-window to wait for it, or --ignore-maintenance-window to %s it anyway",
+			action, host.Name, window, next.Format(time.RFC1123), action)
+	}
+
+	fmt.Fprintf(out, "Waiting until %s to %s %s, when its maintenance window (%s) opens\n", next.Format(time.RFC1123), action, host.Name, window)
+	time.Sleep(time.Until(next))
+	return nil
+}
+
+// The configuration a host was running before activation, used by --rollback-on-failure
+type previousSystem struct {
+	Path string
+	// The generation of the system profile (switch and boot only)
+	Generation int
+}
+
+// Record the configuration to go back to. For switch and boot, that's the current generation of the system profile,
+// which is also what the host boots into, while test only changes the running system.
+func recordPreviousSystem(sshContext *ssh.SSHContext, host *nix.Host) (*previousSystem, error) {
+	if deploySwitchAction != "switch" && deploySwitchAction != "boot" {
+		path, err := sshContext.GetCurrentSystem(host)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(sshContext.Stderr(), "Recorded previous configuration of %s: %s\n", host.Name, path)
+		return &previousSystem{Path: path}, nil
+	}
+
+	generation, err := sshContext.GetSystemGeneration(host)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := sshContext.GetGenerationPath(host, generation)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(sshContext.Stderr(), "Recorded previous configuration of %s: %s (generation %d)\n", host.Name, path, generation)
+
+	return &previousSystem{Path: path, Generation: generation}, nil
+}
+
+// Reactivate the previous configuration, pointing the system profile back at the previous generation for "switch"
+func (previous *previousSystem) reactivate(sshContext *ssh.SSHContext, host *nix.Host) error {
+	out := sshContext.Stderr()
+	fmt.Fprintf(out, "Rolling back %s to previous configuration: %s\n", host.Name, previous.Path)
+
+	err := sshContext.ActivateGeneration(host, previous.Path, previous.Generation, deploySwitchAction)
+	if err != nil {
+		return err
+	}
+
+	if previous.Generation != 0 {
+		fmt.Fprintf(out, "Rolled back %s to previous configuration (generation %d)\n", host.Name, previous.Generation)
+	} else {
+		fmt.Fprintf(out, "Rolled back %s to previous configuration\n", host.Name)
+	}
+	return nil
+}
+
+const (
+	phasePreBuildHooks   = "pre-build-hooks"
+	phaseBuild           = "build"
+	phaseLock            = "lock"
+	phaseDiff            = "diff"
+	phasePush            = "push"
+	phaseSecrets         = "upload-secrets"
+	phasePreDeployChecks = "pre-deploy-checks"
+	phaseMaintenance     = "maintenance-window"
+	phaseActivation      = "activation"
+	phaseReboot          = "reboot"
+	phaseConfirmation    = "confirmation"
+	phaseHealthChecks    = "health-checks"
+)
+
+// Wraps the error that made a host fail, along with the phase it failed in
+type phaseError struct {
+	Phase string
+	Err   error
+}
+
+func (e *phaseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.Err
+}
+
+// Whether pre-deploy checks or health checks failed, rather than morph itself
+func (e *phaseError) isCheck() bool {
+	return e.Phase == phasePreDeployChecks || e.Phase == phaseHealthChecks
+}
+
+type hostResult struct {
+	Host   string
+	Status string
+	Phase  string
+	Reason string
+}
+
+// Outcome of each host, summarized at the end of a --keep-going run
+type hostResults struct {
+	hosts   []nix.Host
+	results []hostResult
+	lock    sync.Mutex
+}
+
+func newHostResults(hosts []nix.Host) *hostResults {
+	return &hostResults{
+		hosts:   hosts,
+		results: make([]hostResult, 0),
+	}
+}
+
+func (r *hostResults) add(result hostResult) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.results = append(r.results, result)
+}
+
+func (r *hostResults) succeeded(host string) {
+	r.add(hostResult{Host: host, Status: "succeeded"})
+}
+
+func (r *hostResults) failed(host string, err error) {
+	result := hostResult{Host: host, Status: "failed", Reason: err.Error()}
+	var phaseErr *phaseError
+	if errors.As(err, &phaseErr) {
+		result.Phase = phaseErr.Phase
+	}
+	r.add(result)
+}
+
+func (r *hostResults) skipped(host string, reason string) {
+	r.add(hostResult{Host: host, Status: "skipped", Reason: reason})
+}
+
+func (r *hostResults) count(status string) (count int) {
+	for _, result := range r.results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return
+}
+
+func (r *hostResults) failedCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.count("failed")
+}
+
+// Whether failed hosts should be recorded, rather than stopping the run
+func (r *hostResults) keepGoing() bool {
+	return keepGoing || maxFailures.isSet()
+}
+
+// Whether the --max-failures budget has been used up
+func (r *hostResults) exhausted() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	limit := maxFailures.hosts(deployedHostCount(r.hosts))
+	return limit > 0 && r.count("failed") >= limit
+}
+
+// With --keep-going, print the summary and return an error if any host failed
+func (r *hostResults) finish() error {
+	if !r.keepGoing() {
+		return nil
+	}
+
+	if r.exhausted() {
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintf(os.Stderr, "Not touching additional hosts, since %d hosts have failed (--max-failures %s).\n", r.count("failed"), maxFailures.String())
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.results = append(r.results, r.unreached()...)
+
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintf(os.Stderr, "Summary: %d succeeded, %d failed, %d skipped\n", r.count("succeeded"), r.count("failed"), r.count("skipped"))
+	for _, result := range r.results {
+		switch {
+		case result.Status == "failed" && result.Phase != "":
+			fmt.Fprintf(os.Stderr, "\t%s: failed during %s: %s\n", result.Host, result.Phase, result.Reason)
+		case result.Reason != "":
+			fmt.Fprintf(os.Stderr, "\t%s: %s (%s)\n", result.Host, result.Status, result.Reason)
+		default:
+			fmt.Fprintf(os.Stderr, "\t%s: %s\n", result.Host, result.Status)
+		}
+	}
+
+	if failed := r.count("failed"); failed > 0 {
+		return fmt.Errorf("%d of %d hosts failed", failed, len(r.results))
+	}
+	return nil
+}
+
+// Results for the hosts that were never reached
+func (r *hostResults) unreached() (results []hostResult) {
+	reached := make(map[string]bool)
+	for _, result := range r.results {
+		reached[result.Host] = true
+	}
+	for _, host := range r.hosts {
+		if !reached[host.Name] {
+			results = append(results, hostResult{Host: host.Name, Status: "skipped", Reason: "not reached"})
+		}
+	}
+	return
+}
+
+// The outcome of every host so far, as reported in the summary event
+func (r *hostResults) summary() []events.HostResult {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	summary := make([]events.HostResult, 0)
+	for _, result := range append(append([]hostResult{}, r.results...), r.unreached()...) {
+		summary = append(summary, events.HostResult(result))
+	}
+	return summary
+}
+
+// Value of --max-failures; either an absolute number of hosts, or a percentage of the selected hosts deployed to
+type failureLimit struct {
+	value   int
+	percent bool
+	set     bool
+}
+
+func (limit *failureLimit) Set(value string) error {
+	number := strings.TrimSuffix(value, "%")
+	parsed, err := strconv.Atoi(number)
+	if err != nil || parsed < 1 {
+		return fmt.Errorf("expected a positive number of hosts or a percentage, got '%s'", value)
+	}
+
+	limit.percent = number != value
+	if limit.percent && parsed > 100 {
+		return fmt.Errorf("expected a percentage of at most 100%%, got '%s'", value)
+	}
+
+	limit.value = parsed
+	limit.set = true
+	return nil
+}
+
+func (limit *failureLimit) String() string {
+	if limit.percent {
+		return fmt.Sprintf("%d%%", limit.value)
+	}
+	return strconv.Itoa(limit.value)
+}
+
+func (limit *failureLimit) isSet() bool {
+	return limit.set
+}
+
+// Number of hosts that are deployed to, rather than only built
+func deployedHostCount(hosts []nix.Host) (count int) {
+	for _, host := range hosts {
+		if !host.BuildOnly {
+			count++
+		}
+	}
+	return
+}
+
+// Number of failed hosts that exhausts the budget, out of hostCount deployed hosts. 0 means no limit.
+func (limit *failureLimit) hosts(hostCount int) int {
+	if !limit.set {
+		return 0
+	}
+	if limit.percent {
+		// round up, so any percentage allows at least one failure
+		return (limit.value*hostCount + 99) / 100
+	}
+	return limit.value
+}
+
+// Describe a rollout wave by its tags; the last wave holds the hosts not matching any of the configured waves
+func waveDescription(waves []nix.RolloutWave, index int) string {
+	if index >= len(waves) {
+		return "remaining hosts"
+	}
+	return "tags: " + strings.Join(waves[index].Tags, ",")
+}
+
+func hasHosts(waves [][]nix.Host) bool {
+	for _, wave := range waves {
+		if len(wave) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Split hosts into consecutive batches of at most size hosts. A size below 1 is treated as 1.
+func batchHosts(hosts []nix.Host, size int) (batches [][]nix.Host) {
+	if size < 1 {
+		size = 1
+	}
+
+	for start := 0; start < len(hosts); start += size {
+		end := start + size
+		if end > len(hosts) {
+			end = len(hosts)
+		}
+		batches = append(batches, hosts[start:end])
+	}
+
+	return
+}
+
+// Run fn for every host in the batch concurrently, and wait for all of them to finish.
+// When running more than one host at a time, each host gets its own SSH context writing host-prefixed lines.
+// The returned errors are indexed like the batch.
+func runBatch(sshContext *ssh.SSHContext, batch []nix.Host, fn func(*ssh.SSHContext, nix.Host) error) ([]error, error) {
+	errs := make([]error, len(batch))
+
+	if len(batch) == 1 {
+		errs[0] = fn(sshContext, batch[0])
+		return errs, nil
+	}
+
+	// make sure the sudo password is known before the context is copied
+	if err := sshContext.PrepareSudoPassword(); err != nil {
+		return errs, err
+	}
+
+	wg := sync.WaitGroup{}
+	for index, host := range batch {
+		wg.Add(1)
+		go func(index int, host nix.Host) {
+			defer wg.Done()
+
+			out := utils.NewPrefixWriter(os.Stderr, host.Name)
+			errs[index] = fn(sshContext.WithOutput(out), host)
+			if errs[index] != nil {
+				fmt.Fprintln(out, errs[index])
+			}
+			out.Flush()
+		}(index, host)
+	}
+	wg.Wait()
+
+	return errs, nil
+}
+
+func execRollback(hosts []nix.Host) error {
+	sshContext := createSSHContext()
+
+	for _, host := range hosts {
+		if host.BuildOnly {
+			fmt.Fprintf(os.Stderr, "Rollback is disabled for build-only host: %s\n", host.Name)
+			continue
+		}
+
+		fmt.Fprintln(os.Stderr, "** "+host.Name)
+
+		// the lock is taken first, so a concurrent deploy can't change the generations after they have been read
+		if !*dryRun {
+			err := lockHost(sshContext, &host)
+			if err != nil {
+				return err
+			}
+		}
+
+		generation, configuration, err := getRollbackGeneration(sshContext, &host)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Executing '%s' for generation %d (%s)\n", rollbackAction, generation, configuration)
+		if *dryRun {
+			fmt.Fprintln(os.Stderr)
+			continue
+		}
+
+		err = sshContext.ActivateGeneration(&host, configuration, generation, rollbackAction)
+		events.Emit(events.Event{Event: events.Activation, Host: host.Name, Action: rollbackAction, Path: configuration}.Outcome(err))
+		if err != nil {
+			return err
+		}
+		recordActivation(sshContext, &host, configuration, rollbackAction, "rollback")
+		fmt.Fprintln(os.Stderr)
+
+		if !skipHealthChecks {
+			err := healthchecks.PerformHealthChecks(sshContext, &host, timeout)
+			if err != nil {
+				fmt.Fprintln(os.Stderr)
+				fmt.Fprintln(os.Stderr, "Not rolling back additional hosts, since a host health check failed.")
+				utils.Exit(1)
+			}
+		}
+
+		fmt.Fprintln(os.Stderr, "Done:", host.Name)
+	}
+
+	return nil
+}
+
+// Find the generation to roll back to; either the one given by --generation, or the one before the current generation
+func getRollbackGeneration(sshContext *ssh.SSHContext, host *nix.Host) (generation int, configuration string, err error) {
+	generations, current, err := sshContext.GetSystemGenerations(host)
+	if err != nil {
+		return 0, "", err
+	}
+
+	for _, candidate := range generations {
+		if rollbackGeneration > 0 {
+			if candidate == rollbackGeneration {
+				generation = candidate
+			}
+		} else if candidate < current {
+			generation = candidate
+		}
+	}
+
+	if generation == 0 {
+		if rollbackGeneration > 0 {
+			return 0, "", fmt.Errorf("Generation %d doesn't exist on host %s", rollbackGeneration, host.Name)
+		}
+		return 0, "", fmt.Errorf("Host %s has no generation before the current generation (%d)", host.Name, current)
+	}
+
+	configuration, err = sshContext.GetGenerationPath(host, generation)
+	return generation, configuration, err
+}
+
+func execDiff(hosts []nix.Host) error {
+	resultPath, err := realiseHosts(hosts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr)
+
+	// with --output=json, stdout is reserved for events
+	var out io.Writer = os.Stdout
+	if events.Streaming() {
+		out = os.Stderr
+	}
+
+	sshContext := createSSHContext().WithOutput(out)
+	for _, host := range hosts {
+		if host.BuildOnly {
+			fmt.Fprintf(os.Stderr, "Diff is disabled for build-only host: %s\n", host.Name)
+			continue
+		}
+
+		err = showDiff(sshContext, host, resultPath)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out)
+	}
+
+	return nil
+}
+
+func showDiff(sshContext *ssh.SSHContext, host nix.Host, resultPath string) error {
+	if host.BuildOnTarget {
+		fmt.Fprintf(sshContext.Stderr(), "The changes for %s aren't known, since it's built on the host\n", host.Name)
+		return nil
+	}
+
+	configuration, err := nix.GetNixSystemPath(host, resultPath)
+	if err != nil {
+		return err
+	}
+
+	closureDiff, err := getNixContext(sshContext).DiffSystemClosure(sshContext, host, configuration)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sshContext.Stderr(), "Changes for %s:\n", host.Name)
+	nix.PrintClosureDiff(sshContext.Stderr(), closureDiff)
+
+	return nil
+}
+
+// Take the deployment lock of a host (taking it over with --force-unlock), and release it when morph exits
+func lockHost(sshContext *ssh.SSHContext, host *nix.Host) error {
+	deploymentPath, err := absDeployment()
+	if err != nil {
+		return err
+	}
+
+	if forceUnlock {
+		err = sshContext.RemoveLock(host)
+		if err != nil {
+			return err
+		}
+	}
+
+	lock := ssh.NewLock(deploymentPath)
+	err = sshContext.AcquireLock(host, lock)
+	if err != nil {
+		var lockedErr *ssh.LockedError
+		if errors.As(err, &lockedErr) {
+			return fmt.Errorf("%s. Use --force-unlock to take over the lock, if the other deployment is no longer running.", lockedErr)
+		}
+		return err
+	}
+
+	utils.AddFinalizer(func() {
+		_ = sshContext.ReleaseLock(host, lock)
+	})
+
+	return nil
+}
+
+// Run the network wide pre-build hooks once, followed by the pre-build hooks of each host
+func runPreBuildHooks(hosts []nix.Host, meta nix.DeploymentMetadata) error {
+	names := make([]string, 0)
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+
+	env := hookEnv("")
+	env["MORPH_HOSTS"] = strings.Join(names, ",")
+	err := hooks.RunLocal(os.Stderr, hooks.PreBuild, meta.Hooks.PreBuild, env)
+	if err != nil {
+		return err
+	}
+
+	ran := len(meta.Hooks.PreBuild) > 0
+	sshContext := createSSHContext()
+	for _, host := range hosts {
+		err = hooks.Run(sshContext, hooks.PreBuild, &host, host.Hooks.PreBuild, hookEnv(""))
+		if err != nil {
+			return err
+		}
+		ran = ran || len(host.Hooks.PreBuild) > 0
+	}
+
+	if ran {
+		fmt.Fprintln(os.Stderr)
+	}
+	return nil
+}
+
+// Run the network wide hooks of a phase, followed by those of the host
+func runHooks(sshContext *ssh.SSHContext, phase string, host *nix.Host, meta nix.DeploymentMetadata, resultPath string) error {
+	phaseHooks := append(append([]hooks.Hook{}, meta.Hooks.Phase(phase)...), host.Hooks.Phase(phase)...)
+	if len(phaseHooks) == 0 {
+		return nil
+	}
+
+	configuration, err := nix.GetNixSystemPath(*host, resultPath)
+	if err != nil {
+		return &phaseError{Phase: phase + "-hooks", Err: err}
+	}
+
+	err = hooks.Run(sshContext, phase, host, phaseHooks, hookEnv(configuration))
+	if err != nil {
+		return &phaseError{Phase: phase + "-hooks", Err: err}
+	}
+
+	fmt.Fprintln(sshContext.Stderr())
+	return nil
+}
+
+// The environment of local hooks, in addition to the host metadata
+func hookEnv(configuration string) map[string]string {
+	deploymentPath, err := absDeployment()
+	if err != nil {
+		deploymentPath = deployment
+	}
+
+	env := map[string]string{
+		"MORPH_DEPLOYMENT":    deploymentPath,
+		"MORPH_SWITCH_ACTION": deploySwitchAction,
+	}
+	if configuration != "" {
+		env["MORPH_SYSTEM"] = configuration
+	}
+	return env
+}
+
+// Add a record of an activation to the history kept on the host. Failing to do so doesn't fail the deployment,
+// since the configuration has already been activated.
+func recordActivation(sshContext *ssh.SSHContext, host *nix.Host, configuration string, action string, command string) {
+	deploymentPath, err := absDeployment()
+	if err != nil {
+		deploymentPath = deployment
+	}
+
+	err = sshContext.AddHistoryRecord(host, ssh.HistoryRecord{
+		Time:        time.Now().UTC(),
+		System:      configuration,
+		Action:      action,
+		Command:     command,
+		Deployer:    ssh.Deployer(),
+		Deployment:  deploymentPath,
+		GitRevision: gitRevision(deploymentDirectory()),
+	})
+	if err != nil {
+		fmt.Fprintf(sshContext.Stderr(), "Couldn't record the activation in the history of %s: %s\n", host.Name, err)
+	}
+}
+
+// Returns the git revision checked out in dir (suffixed with -dirty if there are uncommitted changes), or an empty
+// string if dir isn't part of a git repository
+func gitRevision(dir string) string {
+	revision, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+
+	result := strings.TrimSpace(string(revision))
+	if changes, err := exec.Command("git", "-C", dir, "status", "--porcelain", "--untracked-files=no").Output(); err == nil && len(bytes.TrimSpace(changes)) > 0 {
+		result += "-dirty"
+	}
+	return result
+}
+
+type hostHistoryRecord struct {
+	Host string `json:"host"`
+	ssh.HistoryRecord
+}
+
+func execHistory(hosts []nix.Host) error {
+	sshContext := createSSHContext()
+
+	records := make([]hostHistoryRecord, 0)
+	var errs []error
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+
+		hostRecords, err := sshContext.GetHistory(&host)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, record := range hostRecords {
+			records = append(records, hostHistoryRecord{Host: host.Name, HistoryRecord: record})
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	if asJson || events.Streaming() {
+		if err := printJson(records); err != nil {
+			return err
+		}
+	} else if len(records) == 0 {
+		fmt.Fprintln(os.Stderr, "No activations have been recorded.")
+	} else {
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "TIME\tHOST\tCOMMAND\tACTION\tSYSTEM\tDEPLOYER\tREVISION")
+		for _, record := range records {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.Time.Local().Format("2006-01-02 15:04:05"), record.Host,
+				record.Command, record.Action, shortStorePath(record.System), record.Deployer, shortRevision(record.GitRevision))
+		}
+		table.Flush()
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("couldn't get the history of %d hosts", len(errs))
+	}
+
+	return nil
+}
+
+func shortRevision(revision string) string {
+	if revision == "" {
+		return "-"
+	}
+
+	suffix := ""
+	if strings.HasSuffix(revision, "-dirty") {
+		revision = strings.TrimSuffix(revision, "-dirty")
+		suffix = "-dirty"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	return revision + suffix
+}
+
+type hostLock struct {
+	Host string `json:"host"`
+	ssh.Lock
+}
+
+func execLocks(hosts []nix.Host) error {
+	sshContext := createSSHContext()
+
+	heldLocks := make([]hostLock, 0)
+	var errs []error
+	for _, host := range hosts {
+		if host.BuildOnly {
+			continue
+		}
+
+		lock, err := sshContext.GetLock(&host)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if lock != nil {
+			heldLocks = append(heldLocks, hostLock{Host: host.Name, Lock: *lock})
+		}
+	}
+
+	if asJson || events.Streaming() {
+		if err := printJson(heldLocks); err != nil {
+			return err
+		}
+	} else if len(heldLocks) == 0 {
+		fmt.Fprintln(os.Stderr, "No deployment locks are held.")
+	} else {
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "HOST\tHOLDER\tSINCE\tDEPLOYMENT")
+		for _, lock := range heldLocks {
+			if lock.Holder == "" {
+				fmt.Fprintf(table, "%s\t(being taken)\t-\t-\n", lock.Host)
+				continue
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", lock.Host, lock.Holder, lock.Time.Local().Format(time.RFC1123), lock.Deployment)
+		}
+		table.Flush()
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("couldn't check the deployment lock of %d hosts", len(errs))
+	}
+
+	return nil
+}
+
+const (
+	statusUpToDate          = "up-to-date"
+	statusPendingActivation = "pending-activation"
+	statusPendingReboot     = "pending-reboot"
+	statusUnreachable       = "unreachable"
+	statusBuildOnly         = "build-only"
+)
+
+type hostStatus struct {
+	Name          string `json:"name"`
+	Status        string `json:"status"`
+	BuiltSystem   string `json:"builtSystem"`
+	CurrentSystem string `json:"currentSystem,omitempty"`
+	BootedSystem  string `json:"bootedSystem,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+func execStatus(hosts []nix.Host) error {
+	resultPath, err := realiseHosts(hosts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr)
+
+	sshContext := createSSHContext()
+
+	statuses := make([]hostStatus, 0)
+	for _, host := range hosts {
+		fmt.Fprintf(os.Stderr, "Getting status of %s (%s)\n", host.Name, host.TargetHost)
+		statuses = append(statuses, getHostStatus(sshContext, &host, resultPath))
+	}
+	fmt.Fprintln(os.Stderr)
+
+	if asJson || events.Streaming() {
+		return printJson(statuses)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "HOST\tSTATUS\tBUILT\tCURRENT\tBOOTED")
+	for _, status := range statuses {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", status.Name, status.Status,
+			shortStorePath(status.BuiltSystem), shortStorePath(status.CurrentSystem), shortStorePath(status.BootedSystem))
+	}
+	table.Flush()
+
+	for _, status := range statuses {
+		if status.Error != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", status.Name, status.Error)
+		}
+	}
+
+	return nil
+}
+
+func getHostStatus(sshContext *ssh.SSHContext, host *nix.Host, resultPath string) (status hostStatus) {
+	status.Name = host.Name
+
+	var err error
+	status.BuiltSystem, err = nix.GetNixSystemPath(*host, resultPath)
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+
+	if host.BuildOnly {
+		status.Status = statusBuildOnly
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			status.Status = statusUnreachable
+			status.Error = err.Error()
+		}
+	}()
+
+	status.CurrentSystem, err = sshContext.GetCurrentSystem(host)
+	if err != nil {
+		return
+	}
+
+	status.BootedSystem, err = sshContext.GetBootedSystem(host)
+	if err != nil {
+		return
+	}
+
+	if status.CurrentSystem != status.BuiltSystem {
+		status.Status = statusPendingActivation
+		return
+	}
+
+	needsReboot, err := sshContext.NeedsReboot(host, status.CurrentSystem)
+	if err != nil {
+		return
+	}
+
+	if needsReboot {
+		status.Status = statusPendingReboot
+	} else {
+		status.Status = statusUpToDate
+	}
+
+	return
+}
+
+// Shorten /nix/store/<hash>-<name> to the first characters of the hash, for use in tables
+func shortStorePath(path string) string {
+	if path == "" {
+		return "-"
+	}
+
+	base := filepath.Base(path)
+	if len(base) > 8 {
+		return base[:8]
+	}
+	return base
+}
+
+func createSSHContext() *ssh.SSHContext {
+	return &ssh.SSHContext{
+		AskForSudoPassword:     askForSudoPasswd,
+		GetSudoPasswordCommand: passCmd,
 		IdentityFile:           os.Getenv("SSH_IDENTITY_FILE"),
 		DefaultUsername:        os.Getenv("SSH_USER"),
 		SkipHostKeyCheck:       os.Getenv("SSH_SKIP_HOST_KEY_CHECK") != "",
@@ -486,7 +2211,14 @@ func execHealthCheck(hosts []nix.Host) error {
 			fmt.Fprintf(os.Stderr, "Healthchecks are disabled for build-only host: %s\n", host.Name)
 			continue
 		}
-		err = healthchecks.PerformHealthChecks(sshContext, &host, timeout)
+		hostContext, captureErr := captureOutput(sshContext, host)
+		if captureErr != nil {
+			return captureErr
+		}
+		events.Emit(events.Event{Event: events.HostStart, Host: host.Name})
+		events.Emit(events.Event{Event: events.Phase, Host: host.Name, Phase: phaseHealthChecks})
+		err = healthchecks.PerformHealthChecks(hostContext, &host, timeout)
+		emitHostOutcome(host, phaseHealthChecks, err)
 	}
 
 	if err != nil {
@@ -497,25 +2229,81 @@ func execHealthCheck(hosts []nix.Host) error {
 }
 
 func execUploadSecrets(sshContext *ssh.SSHContext, hosts []nix.Host, phase *string) error {
+	results := newHostResults(hosts)
 	for _, host := range hosts {
 		if host.BuildOnly {
 			fmt.Fprintf(os.Stderr, "Secret upload is disabled for build-only host: %s\n", host.Name)
+			results.skipped(host.Name, "build-only")
 			continue
 		}
-		singleHostInList := []nix.Host{host}
 
-		err := secretsUpload(sshContext, singleHostInList, phase)
+		hostContext, err := captureOutput(sshContext, host)
 		if err != nil {
 			return err
 		}
+		events.Emit(events.Event{Event: events.HostStart, Host: host.Name})
+		events.Emit(events.Event{Event: events.Phase, Host: host.Name, Phase: phaseSecrets})
+		err = uploadSecretsToHost(hostContext, host, phase)
+		emitHostOutcome(host, phaseSecrets, err)
+		if err != nil {
+			results.failed(host.Name, err)
+			if results.exhausted() {
+				break
+			}
+			if results.keepGoing() {
+				continue
+			}
 
-		if !skipHealthChecks {
-			err = healthchecks.PerformHealthChecks(sshContext, &host, timeout)
-			if err != nil {
+			var phaseErr *phaseError
+			if errors.As(err, &phaseErr) && phaseErr.isCheck() {
 				fmt.Fprintln(os.Stderr)
 				fmt.Fprintln(os.Stderr, "Not uploading to additional hosts, since a host health check failed.")
-				return err
 			}
+			return err
+		}
+		results.succeeded(host.Name)
+	}
+
+	return results.finish()
+}
+
+// With --report, capture the output of a host for the report
+func captureOutput(sshContext *ssh.SSHContext, host nix.Host) (*ssh.SSHContext, error) {
+	if testReport == nil {
+		return sshContext, nil
+	}
+
+	// make sure the sudo password is known before the context is copied
+	if err := sshContext.PrepareSudoPassword(); err != nil {
+		return nil, err
+	}
+	return sshContext.WithOutput(io.MultiWriter(sshContext.Stderr(), testReport.Output(host.Name))), nil
+}
+
+func emitHostOutcome(host nix.Host, phase string, err error) {
+	if err == nil {
+		events.Emit(events.Event{Event: events.HostDone, Host: host.Name})
+		return
+	}
+
+	var phaseErr *phaseError
+	if errors.As(err, &phaseErr) {
+		phase = phaseErr.Phase
+	}
+	events.Emit(events.Event{Event: events.HostFailed, Host: host.Name, Phase: phase, Error: err.Error()})
+}
+
+// Upload secrets to a single host, and run its health checks afterwards
+func uploadSecretsToHost(sshContext *ssh.SSHContext, host nix.Host, phase *string) error {
+	err := secretsUpload(sshContext, []nix.Host{host}, phase)
+	if err != nil {
+		return &phaseError{Phase: phaseSecrets, Err: err}
+	}
+
+	if !skipHealthChecks {
+		err = healthchecks.PerformHealthChecks(sshContext, &host, timeout)
+		if err != nil {
+			return &phaseError{Phase: phaseHealthChecks, Err: err}
 		}
 	}
 
@@ -536,7 +2324,7 @@ func execListSecrets(hosts []nix.Host) {
 }
 
 func execListSecretsAsJson(hosts []nix.Host) error {
-	deploymentDir, err := filepath.Abs(filepath.Dir(deployment))
+	deploymentDir, err := filepath.Abs(deploymentDirectory())
 	if err != nil {
 		return err
 	}
@@ -555,36 +2343,58 @@ func execListSecretsAsJson(hosts []nix.Host) error {
 		}
 	}
 
-	jsonSecrets, err := json.MarshalIndent(secretsByHost, "", "  ")
-	if err != nil {
-		return err
+	return printJson(secretsByHost)
+}
+
+// Returns the deployment as passed to nix: the absolute path of the deployment file, or the flake output (with the
+// directory of a local flake made absolute)
+func absDeployment() (string, error) {
+	if flake, isFlake := nix.ParseFlake(deployment); isFlake {
+		absFlake, err := flake.Abs()
+		if err != nil {
+			return "", err
+		}
+		return absFlake.String(), nil
 	}
-	fmt.Fprintf(os.Stdout, "%s\n", jsonSecrets)
+	return filepath.Abs(deployment)
+}
 
-	return nil
+// Returns the directory relative paths (e.g. of secrets) are relative to: the directory of the deployment file, or the
+// directory of a local flake
+func deploymentDirectory() string {
+	if flake, isFlake := nix.ParseFlake(deployment); isFlake {
+		if dir := flake.Dir(); dir != "" {
+			return dir
+		}
+		return "."
+	}
+	return filepath.Dir(deployment)
 }
 
-func getHosts(deploymentPath string) (hosts []nix.Host, err error) {
+func getHosts() (hosts []nix.Host, meta nix.DeploymentMetadata, err error) {
 
-	deploymentFile, err := os.Open(deploymentPath)
+	deploymentAbsPath, err := absDeployment()
 	if err != nil {
-		return hosts, err
+		return hosts, meta, err
 	}
 
-	deploymentAbsPath, err := filepath.Abs(deploymentFile.Name())
+	ctx := getNixContext(createSSHContext())
+	deployment, err := ctx.GetMachines(deploymentAbsPath)
 	if err != nil {
-		return hosts, err
+		return hosts, meta, err
 	}
 
-	ctx := getNixContext()
-	deployment, err := ctx.GetMachines(deploymentAbsPath)
-	if err != nil {
-		return hosts, err
+	switch deployment.Meta.NixBackend {
+	case "", nix.LegacyBackend, nix.NixCLIBackend:
+		deploymentNixBackend = deployment.Meta.NixBackend
+	default:
+		return hosts, meta, fmt.Errorf("Unknown network.nixBackend: %s (expected one of: %s)", deployment.Meta.NixBackend, strings.Join(nix.Backends, ", "))
 	}
+	deploymentBuildHost = deployment.Meta.BuildHost
 
 	matchingHosts, err := filter.MatchHosts(deployment.Hosts, selectGlob)
 	if err != nil {
-		return hosts, err
+		return hosts, meta, err
 	}
 
 	var selectedTags []string
@@ -609,13 +2419,66 @@ func getHosts(deploymentPath string) (hosts []nix.Host, err error) {
 	}
 	fmt.Fprintln(os.Stderr)
 
-	return filteredHosts, nil
+	selectedNames := make([]string, 0)
+	for _, host := range filteredHosts {
+		selectedNames = append(selectedNames, host.Name)
+	}
+	events.Emit(events.Event{Event: events.HostsSelected, Deployment: deploymentAbsPath, Hosts: selectedNames})
+
+	return filteredHosts, deployment.Meta, nil
+}
+
+// Asks the user to confirm touching the selected hosts, if any of them have protected tags, unless --confirm-protected is given
+func confirmProtectedHosts(hosts []nix.Host, protectedTags []string) error {
+	protectedHosts := make([]string, 0)
+	for _, host := range hosts {
+		tags := make([]string, 0)
+		for _, tag := range host.GetTags() {
+			for _, protectedTag := range protectedTags {
+				if tag == protectedTag {
+					tags = append(tags, tag)
+				}
+			}
+		}
+		if len(tags) > 0 {
+			protectedHosts = append(protectedHosts, fmt.Sprintf("%s (%s)", host.Name, strings.Join(tags, ",")))
+		}
+	}
+
+	if len(protectedHosts) == 0 || confirmProtected {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "The selection includes %d protected host(s):\n", len(protectedHosts))
+	for _, host := range protectedHosts {
+		fmt.Fprintf(os.Stderr, "\t%s\n", host)
+	}
+	fmt.Fprintln(os.Stderr)
+
+	if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("Refusing to touch protected hosts without confirmation, since stdin isn't a terminal. Use --confirm-protected to continue anyway.")
+	}
+
+	fmt.Fprintf(os.Stderr, "Type 'yes' to continue with all %d selected hosts: ", len(hosts))
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(answer) != "yes" {
+		return errors.New("Aborted, since the protected hosts weren't confirmed")
+	}
+	fmt.Fprintln(os.Stderr)
+
+	return nil
 }
 
-func getNixContext() *nix.NixContext {
+// Makes the nix context for the deployment; sshContext is used to reach the build host
+func getNixContext(sshContext *ssh.SSHContext) *nix.NixContext {
 	evalCmd := os.Getenv("MORPH_NIX_EVAL_CMD")
 	buildCmd := os.Getenv("MORPH_NIX_BUILD_CMD")
 	shellCmd := os.Getenv("MORPH_NIX_SHELL_CMD")
+	nixCmd := os.Getenv("MORPH_NIX_CMD")
+	storeCmd := os.Getenv("MORPH_NIX_STORE_CMD")
 	evalMachines := os.Getenv("MORPH_NIX_EVAL_MACHINES")
 
 	if evalCmd == "" {
@@ -627,28 +2490,68 @@ func getNixContext() *nix.NixContext {
 	if shellCmd == "" {
 		shellCmd = "nix-shell"
 	}
+	if nixCmd == "" {
+		nixCmd = "nix"
+	}
+	if storeCmd == "" {
+		storeCmd = "nix-store"
+	}
+
+	backend := *nixBackend
+	if backend == "" {
+		backend = deploymentNixBackend
+	}
+	if _, isFlake := nix.ParseFlake(deployment); isFlake {
+		backend = nix.NixCLIBackend
+	}
 	if evalMachines == "" {
 		evalMachines = filepath.Join(assetRoot, "eval-machines.nix")
 	}
 
+	buildHostName := *buildHost
+	if buildHostName == "" {
+		buildHostName = deploymentBuildHost
+	}
+
 	return &nix.NixContext{
-		EvalCmd:         evalCmd,
-		BuildCmd:        buildCmd,
-		ShellCmd:        shellCmd,
-		EvalMachines:    evalMachines,
-		ShowTrace:       showTrace,
-		KeepGCRoot:      *keepGCRoot,
-		AllowBuildShell: *allowBuildShell,
+		EvalCmd:           evalCmd,
+		BuildCmd:          buildCmd,
+		ShellCmd:          shellCmd,
+		NixCmd:            nixCmd,
+		StoreCmd:          storeCmd,
+		Backend:           backend,
+		EvalMachines:      evalMachines,
+		ShowTrace:         showTrace,
+		KeepGCRoot:        *keepGCRoot,
+		AllowBuildShell:   *allowBuildShell,
+		BuildHost:         buildHostName,
+		CopyFromBuildHost: *copyFromBuildHost || !systemsStayOnBuildHost,
+		SSHContext:        sshContext,
 	}
 }
 
 func buildHosts(hosts []nix.Host) (resultPath string, err error) {
+	resultPath, err = realiseHosts(hosts)
+	if err != nil {
+		return
+	}
+
+	// with --output=json, the result path is part of the build-result event
+	if !events.Streaming() {
+		fmt.Fprintln(os.Stderr, "nix result path: ")
+		fmt.Println(resultPath)
+	}
+	return
+}
+
+// Like buildHosts, but without writing the result path to stdout
+func realiseHosts(hosts []nix.Host) (resultPath string, err error) {
 	if len(hosts) == 0 {
 		err = errors.New("No hosts selected")
 		return
 	}
 
-	deploymentPath, err := filepath.Abs(deployment)
+	deploymentPath, err := absDeployment()
 	if err != nil {
 		return
 	}
@@ -662,22 +2565,32 @@ func buildHosts(hosts []nix.Host) (resultPath string, err error) {
 		nixBuildTargets = fmt.Sprintf("{ \"out\" = %s; }", nixBuildTarget)
 	}
 
-	ctx := getNixContext()
+	ctx := getNixContext(createSSHContext())
 	resultPath, err = ctx.BuildMachines(deploymentPath, hosts, nixBuildArg, nixBuildTargets)
-
 	if err != nil {
+		events.Emit(events.Event{Event: events.BuildResult, Deployment: deploymentPath}.Outcome(err))
 		return
 	}
 
-	fmt.Fprintln(os.Stderr, "nix result path: ")
-	fmt.Println(resultPath)
+	if events.Streaming() {
+		systems := make(map[string]string)
+		for _, host := range hosts {
+			if system, err := nix.GetNixSystemPath(host, resultPath); err == nil {
+				systems[host.Name] = system
+			}
+		}
+		events.Emit(events.Event{Event: events.BuildResult, Deployment: deploymentPath, Path: resultPath, Systems: systems}.Outcome(nil))
+	}
+
 	return
 }
 
 func pushPaths(sshContext *ssh.SSHContext, filteredHosts []nix.Host, resultPath string) error {
+	out := sshContext.Stderr()
+	nixContext := getNixContext(sshContext)
 	for _, host := range filteredHosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Push is disabled for build-only host: %s\n", host.Name)
+			fmt.Fprintf(out, "Push is disabled for build-only host: %s\n", host.Name)
 			continue
 		}
 
@@ -685,25 +2598,46 @@ func pushPaths(sshContext *ssh.SSHContext, filteredHosts []nix.Host, resultPath
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(os.Stderr, "Pushing paths to %v (%v@%v):\n", host.Name, host.TargetUser, host.TargetHost)
+		fmt.Fprintf(out, "Pushing paths to %v (%v@%v):\n", host.Name, host.TargetUser, host.TargetHost)
 		for _, path := range paths {
-			fmt.Fprintf(os.Stderr, "\t* %s\n", path)
+			fmt.Fprintf(out, "\t* %s\n", path)
 		}
-		err = nix.Push(sshContext, host, paths...)
+		err = nixContext.Push(sshContext, host, paths...)
+		events.Emit(events.Event{Event: events.Push, Host: host.Name, Paths: paths}.Outcome(err))
 		if err != nil {
 			return err
 		}
+
+		if host.BuildOnTarget {
+			fmt.Fprintf(out, "Building the system on %s:\n", host.Name)
+			if err = sshContext.Realise(&host, paths, nix.MkOptionsFromHost(host)...); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+func emitSecretUpload(host nix.Host, name string, secret secrets.Secret, secretErr *secrets.SecretError) {
+	event := events.Event{Event: events.SecretUpload, Host: host.Name, Secret: name, Path: secret.Destination, Status: events.Succeeded}
+	if secretErr != nil {
+		event.Error = secretErr.Error()
+		event.Status = "partial"
+		if secretErr.Fatal {
+			event.Status = events.Failed
+		}
+	}
+	events.Emit(event)
+}
+
 func secretsUpload(ctx ssh.Context, filteredHosts []nix.Host, phase *string) error {
 	// upload secrets
 	// relative paths are resolved relative to the deployment file (!)
-	deploymentDir := filepath.Dir(deployment)
+	deploymentDir := deploymentDirectory()
+	out := ctx.Stderr()
 	for _, host := range filteredHosts {
-		fmt.Fprintf(os.Stderr, "Uploading secrets to %s (%s):\n", host.Name, host.TargetHost)
+		fmt.Fprintf(out, "Uploading secrets to %s (%s):\n", host.Name, host.TargetHost)
 		postUploadActions := make(map[string][]string, 0)
 		for secretName, secret := range host.Secrets {
 			// if phase is nil, upload the secrets no matter what phase it wants
@@ -718,17 +2652,18 @@ func secretsUpload(ctx ssh.Context, filteredHosts []nix.Host, phase *string) err
 			}
 
 			secretErr := secrets.UploadSecret(ctx, &host, secret, deploymentDir)
-			fmt.Fprintf(os.Stderr, "\t* %s (%d bytes).. ", secretName, secretSize)
+			fmt.Fprintf(out, "\t* %s (%d bytes).. ", secretName, secretSize)
+			emitSecretUpload(host, secretName, secret, secretErr)
 			if secretErr != nil {
 				if secretErr.Fatal {
-					fmt.Fprintln(os.Stderr, "Failed")
+					fmt.Fprintln(out, "Failed")
 					return secretErr
 				} else {
-					fmt.Fprintln(os.Stderr, "Partial")
-					fmt.Fprint(os.Stderr, secretErr.Error())
+					fmt.Fprintln(out, "Partial")
+					fmt.Fprint(out, secretErr.Error())
 				}
 			} else {
-				fmt.Fprintln(os.Stderr, "OK")
+				fmt.Fprintln(out, "OK")
 			}
 			if len(secret.Action) > 0 {
 				// ensure each action is only run once
@@ -737,7 +2672,7 @@ func secretsUpload(ctx ssh.Context, filteredHosts []nix.Host, phase *string) err
 		}
 		// Execute post-upload secret actions one-by-one after all secrets have been uploaded
 		for _, action := range postUploadActions {
-			fmt.Fprintf(os.Stderr, "\t- executing post-upload command: "+strings.Join(action, " ")+"\n")
+			fmt.Fprintf(out, "\t- executing post-upload command: "+strings.Join(action, " ")+"\n")
 			// Errors from secret actions will be printed on screen, but we won't stop the flow if they fail
 			ctx.CmdInteractive(&host, timeout, action...)
 		}
@@ -746,12 +2681,35 @@ func secretsUpload(ctx ssh.Context, filteredHosts []nix.Host, phase *string) err
 	return nil
 }
 
+// Like activateConfiguration for a single host, but starts a timer reverting the activation unless it's confirmed
+func activateWithRevert(sshContext *ssh.SSHContext, host nix.Host, resultPath string, revert ssh.Revert) error {
+	out := sshContext.Stderr()
+	fmt.Fprintln(out, "Executing '"+deploySwitchAction+"' on matched hosts:")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "** "+host.Name)
+
+	configuration, err := nix.GetNixSystemPath(host, resultPath)
+	if err != nil {
+		return err
+	}
+
+	err = sshContext.ActivateWithRevert(&host, configuration, deploySwitchAction, revert)
+	events.Emit(events.Event{Event: events.Activation, Host: host.Name, Action: deploySwitchAction, Path: configuration}.Outcome(err))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out)
+	return nil
+}
+
 func activateConfiguration(ctx ssh.Context, filteredHosts []nix.Host, resultPath string) error {
-	fmt.Fprintln(os.Stderr, "Executing '"+deploySwitchAction+"' on matched hosts:")
-	fmt.Fprintln(os.Stderr)
+	out := ctx.Stderr()
+	fmt.Fprintln(out, "Executing '"+deploySwitchAction+"' on matched hosts:")
+	fmt.Fprintln(out)
 	for _, host := range filteredHosts {
 
-		fmt.Fprintln(os.Stderr, "** "+host.Name)
+		fmt.Fprintln(out, "** "+host.Name)
 
 		configuration, err := nix.GetNixSystemPath(host, resultPath)
 		if err != nil {
@@ -759,11 +2717,12 @@ func activateConfiguration(ctx ssh.Context, filteredHosts []nix.Host, resultPath
 		}
 
 		err = ctx.ActivateConfiguration(&host, configuration, deploySwitchAction)
+		events.Emit(events.Event{Event: events.Activation, Host: host.Name, Action: deploySwitchAction, Path: configuration}.Outcome(err))
 		if err != nil {
 			return err
 		}
 
-		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(out)
 	}
 
 	return nil
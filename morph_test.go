@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DBCDK/morph/nix"
+)
+
+func TestFailureLimit(t *testing.T) {
+	tests := []struct {
+		value     string
+		hostCount int
+		// the number of failed hosts exhausting the budget, or -1 if the value is invalid
+		hosts int
+	}{
+		{"3", 10, 3},
+		{"3", 2, 3},
+		{"0", 10, -1},
+		{"0%", 10, -1},
+		{"101%", 10, -1},
+		{"ten", 10, -1},
+		{"100%", 10, 10},
+		{"50%", 10, 5},
+		// percentages round up, so any percentage allows at least one failure
+		{"10%", 15, 2},
+		{"1%", 3, 1},
+		{"100%", 0, 0},
+	}
+
+	for _, test := range tests {
+		var limit failureLimit
+		err := limit.Set(test.value)
+		if test.hosts < 0 {
+			if err == nil {
+				t.Errorf("Expected --max-failures %s to be rejected", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("--max-failures %s: %s", test.value, err)
+			continue
+		}
+		if hosts := limit.hosts(test.hostCount); hosts != test.hosts {
+			t.Errorf("--max-failures %s of %d hosts: expected a limit of %d hosts, got %d", test.value, test.hostCount, test.hosts, hosts)
+		}
+	}
+}
+
+func TestFailureLimitIgnoresBuildOnlyHosts(t *testing.T) {
+	hosts := []nix.Host{{Name: "a"}, {Name: "b"}, {Name: "c", BuildOnly: true}, {Name: "d", BuildOnly: true}}
+	if count := deployedHostCount(hosts); count != 2 {
+		t.Errorf("Expected 2 deployed hosts, got %d", count)
+	}
+}
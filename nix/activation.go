@@ -0,0 +1,86 @@
+package nix
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// The units switch-to-configuration would stop, start, restart and reload, according to dry-activate
+type UnitChanges struct {
+	Stop    []string `json:"stop"`
+	Start   []string `json:"start"`
+	Restart []string `json:"restart"`
+	Reload  []string `json:"reload"`
+}
+
+func (changes *UnitChanges) IsEmpty() bool {
+	return len(changes.Stop) == 0 && len(changes.Start) == 0 && len(changes.Restart) == 0 && len(changes.Reload) == 0
+}
+
+// Parse the output of `switch-to-configuration dry-activate`. Lines that don't describe unit changes are ignored.
+func ParseDryActivation(output string) (changes UnitChanges) {
+	changes = UnitChanges{
+		Stop:    []string{},
+		Start:   []string{},
+		Restart: []string{},
+		Reload:  []string{},
+	}
+
+	lists := map[string]*[]string{
+		"would stop the following units:":    &changes.Stop,
+		"would start the following units:":   &changes.Start,
+		"would restart the following units:": &changes.Restart,
+		"would reload the following units:":  &changes.Reload,
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for prefix, list := range lists {
+			if !strings.HasPrefix(line, prefix) {
+				continue
+			}
+			for _, unit := range strings.Split(strings.TrimPrefix(line, prefix), ",") {
+				if unit = strings.TrimSpace(unit); unit != "" {
+					*list = append(*list, unit)
+				}
+			}
+		}
+	}
+
+	return changes
+}
+
+// Print a table with one row for each kind of change on each host
+func PrintUnitChanges(out io.Writer, hostNames []string, changes map[string]UnitChanges) {
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "HOST\tACTION\tUNITS")
+	for _, name := range hostNames {
+		hostChanges, ok := changes[name]
+		if !ok {
+			continue
+		}
+		if hostChanges.IsEmpty() {
+			fmt.Fprintf(table, "%s\t-\tno changes\n", name)
+			continue
+		}
+
+		for _, action := range []struct {
+			name  string
+			units []string
+		}{
+			{"stop", hostChanges.Stop},
+			{"start", hostChanges.Start},
+			{"restart", hostChanges.Restart},
+			{"reload", hostChanges.Reload},
+		} {
+			if len(action.units) > 0 {
+				fmt.Fprintf(table, "%s\t%s\t%s\n", name, action.name, strings.Join(action.units, ", "))
+			}
+		}
+	}
+	table.Flush()
+}
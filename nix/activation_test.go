@@ -0,0 +1,47 @@
+package nix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDryActivation(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   UnitChanges
+	}{
+		{"no output", "", UnitChanges{Stop: []string{}, Start: []string{}, Restart: []string{}, Reload: []string{}}},
+		{
+			"all kinds of changes",
+			`would stop the following units: nginx.service, old.timer
+would activate the configuration...
+would start the following units: new.service
+would restart the following units: sshd.service,  systemd-journald.service
+would reload the following units: dbus.service
+`,
+			UnitChanges{
+				Stop:    []string{"nginx.service", "old.timer"},
+				Start:   []string{"new.service"},
+				Restart: []string{"sshd.service", "systemd-journald.service"},
+				Reload:  []string{"dbus.service"},
+			},
+		},
+		{
+			"repeated and indented lines",
+			"  would restart the following units: a.service\r\nwould restart the following units: b.service,\n",
+			UnitChanges{Stop: []string{}, Start: []string{}, Restart: []string{"a.service", "b.service"}, Reload: []string{}},
+		},
+		{
+			"unrelated lines",
+			"setting up /etc...\nwould restart systemd\nwould start the following units:\n",
+			UnitChanges{Stop: []string{}, Start: []string{}, Restart: []string{}, Reload: []string{}},
+		},
+	}
+
+	for _, test := range tests {
+		if got := ParseDryActivation(test.output); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.want, got)
+		}
+	}
+}
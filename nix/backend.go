@@ -0,0 +1,368 @@
+package nix
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/DBCDK/morph/events"
+	"github.com/DBCDK/morph/ssh"
+	"github.com/DBCDK/morph/utils"
+)
+
+// The ways morph can run nix (NixContext.Backend, network.nixBackend)
+const (
+	// nix-instantiate, nix-build, nix-shell and nix-copy-closure
+	LegacyBackend = "legacy"
+	// the nix command: nix eval, nix build and nix copy. Always used for flakes.
+	NixCLIBackend = "nix"
+)
+
+var Backends = []string{LegacyBackend, NixCLIBackend}
+
+// Evaluates, builds and pushes deployments
+type Backend interface {
+	GetMachines(deploymentPath string) (Deployment, error)
+	// Prints the value of an attribute of the nodes of the deployment to out
+	EvalHosts(deploymentPath string, attr string, out io.Writer) (string, error)
+	// Returns a directory with a link to the system of each host
+	BuildMachines(deploymentPath string, hosts []Host, nixArgs []string, nixBuildTargets string) (string, error)
+	// Returns the derivation of the system of each host, without building it
+	InstantiateMachines(deploymentPath string, hosts []Host) ([]string, error)
+	Push(ctx *ssh.SSHContext, host Host, paths ...string) error
+	// Copies the closures of the paths from the host to the local store
+	Pull(ctx *ssh.SSHContext, host Host, paths ...string) error
+}
+
+type legacyBackend struct {
+	*NixContext
+}
+
+type nixCLIBackend struct {
+	*NixContext
+}
+
+// Returns the backend selected by ctx.Backend
+func (ctx *NixContext) backend() Backend {
+	if ctx.Backend == NixCLIBackend {
+		return &nixCLIBackend{ctx}
+	}
+	return &legacyBackend{ctx}
+}
+
+func (ctx *NixContext) GetMachines(deploymentPath string) (Deployment, error) {
+	return ctx.backend().GetMachines(deploymentPath)
+}
+
+// Prints the value of an attribute of the nodes of the deployment on stdout, or as a result event with --output=json
+func (ctx *NixContext) EvalHosts(deploymentPath string, attr string) (string, error) {
+	if !events.Streaming() {
+		return ctx.backend().EvalHosts(deploymentPath, attr, os.Stdout)
+	}
+
+	var out bytes.Buffer
+	path, err := ctx.backend().EvalHosts(deploymentPath, attr, &out)
+	if err == nil {
+		events.Emit(events.Event{Event: events.Result, Data: strings.TrimSpace(out.String())})
+	}
+	return path, err
+}
+
+// Builds the hosts, by one build per distinct set of nix options (deployment.nixConfig). The results of several builds
+// are linked together in a single directory, which is kept like the result of a single build (see keepResult).
+// Hosts built on the target (deployment.buildOnTarget) are only instantiated, and get a link to the derivation of their
+// system (see GetNixSystemDerivation) along with the link to the (not yet built) system.
+// With a build host (ctx.BuildHost), the other hosts are instantiated the same way, and built on the build host.
+func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArgs []string, nixBuildTargets string) (string, error) {
+	localHosts := make([]Host, 0)
+	targetHosts := make([]Host, 0)
+	for _, host := range hosts {
+		if host.BuildOnTarget {
+			targetHosts = append(targetHosts, host)
+		} else {
+			localHosts = append(localHosts, host)
+		}
+	}
+
+	groups := groupByNixConfig(localHosts)
+	if len(groups) == 1 && len(targetHosts) == 0 && ctx.BuildHost == "" {
+		return ctx.backend().BuildMachines(deploymentPath, hosts, nixArgs, nixBuildTargets)
+	}
+	if len(targetHosts) > 0 && nixBuildTargets != "" {
+		return "", errors.New("--build-target and --build-target-file aren't supported for hosts built on the target")
+	}
+	if ctx.BuildHost != "" && nixBuildTargets != "" {
+		return "", errors.New("--build-target and --build-target-file aren't supported with a build host")
+	}
+
+	resultPath, err := ioutil.TempDir("", "morph-")
+	if err != nil {
+		return "", err
+	}
+	utils.AddFinalizer(func() {
+		os.RemoveAll(resultPath)
+	})
+
+	// the paths kept from being garbage collected with --keep-result, by the name of their link in the result
+	roots := make(map[string]string)
+
+	for index, group := range groups {
+		names := make([]string, 0)
+		for _, host := range group {
+			names = append(names, host.Name)
+		}
+		if len(groups) > 1 {
+			fmt.Fprintf(os.Stderr, "Building %s (nix options: %s)\n", strings.Join(names, ", "), describeNixConfig(group[0].NixConfig))
+		}
+
+		if ctx.BuildHost != "" {
+			if err = ctx.buildOnBuildHost(deploymentPath, group, resultPath, roots); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		// the result of the group is only needed until it's linked into the combined result
+		groupCtx := *ctx
+		groupCtx.KeepGCRoot = false
+		groupResult, err := groupCtx.backend().BuildMachines(deploymentPath, group, nixArgs, nixBuildTargets)
+		if err != nil {
+			return "", err
+		}
+
+		for _, host := range group {
+			// link to the system itself (see GetNixSystemPath), or to the directory of the build targets of the host
+			target := filepath.Join(groupResult, host.Name)
+			if system, err := os.Readlink(target); err == nil {
+				target = system
+				roots[host.Name] = system
+			} else {
+				roots[fmt.Sprintf(".result-%d", index+1)] = groupResult
+			}
+			if err = os.Symlink(target, filepath.Join(resultPath, host.Name)); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if len(targetHosts) > 0 {
+		derivations, _, err := ctx.instantiateMachines(deploymentPath, targetHosts, resultPath)
+		if err != nil {
+			return "", err
+		}
+		for index, host := range targetHosts {
+			fmt.Fprintf(os.Stderr, "%s is built on the host: %s\n", host.Name, derivations[index])
+		}
+	}
+
+	return ctx.keepResult(resultPath, roots, gcRootPath(deploymentPath))
+}
+
+// Returns where the result of building a deployment is kept with --keep-result, or "" if it can't be kept
+func gcRootPath(deploymentPath string) string {
+	if flake, isFlake := ParseFlake(deploymentPath); isFlake {
+		if flake.Dir() == "" {
+			return ""
+		}
+		return filepath.Join(flake.Dir(), ".gcroots", flake.Name)
+	}
+	return filepath.Join(filepath.Dir(deploymentPath), ".gcroots", filepath.Base(deploymentPath))
+}
+
+// Makes a directory of links to the results of a build outlive morph, like the result of a single nix-build. With
+// ctx.KeepGCRoot the links are recreated in gcRoot, where the roots (by the name of their link) are registered as GC
+// roots. Otherwise the directory is added to the store, without keeping the paths it links to.
+func (ctx *NixContext) keepResult(linkDir string, roots map[string]string, gcRoot string) (string, error) {
+	if ctx.KeepGCRoot && gcRoot != "" {
+		err := os.RemoveAll(gcRoot)
+		if err == nil {
+			err = os.MkdirAll(gcRoot, 0755)
+		}
+		if err == nil {
+			err = ctx.addGCRoots(linkDir, roots, gcRoot)
+		}
+		if err == nil {
+			return gcRoot, nil
+		}
+		fmt.Fprintf(os.Stderr, "Unable to create GC root, skipping: %s\n", err)
+	}
+
+	cmd := exec.Command(ctx.StoreCmd, "--add", linkDir)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error while running `%s`: %s", cmd.String(), err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (ctx *NixContext) addGCRoots(linkDir string, roots map[string]string, gcRoot string) error {
+	for name, path := range roots {
+		cmd := exec.Command(ctx.StoreCmd, "--realise", "--add-root", filepath.Join(gcRoot, name), "--indirect", path)
+		cmd.Stdout = io.Discard
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("Error while running `%s`: %s", cmd.String(), err)
+		}
+	}
+
+	// the other links, e.g. to derivations and to systems that aren't built locally
+	entries, err := os.ReadDir(linkDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, isRoot := roots[entry.Name()]; isRoot {
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(linkDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err = os.Symlink(target, filepath.Join(gcRoot, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Instantiates the systems of the hosts, and links the derivation (as host.drv) and the (not yet built) system (as
+// host) of each host in resultPath
+func (ctx *NixContext) instantiateMachines(deploymentPath string, hosts []Host, resultPath string) (derivations []string, systems []string, err error) {
+	derivations, err = ctx.backend().InstantiateMachines(deploymentPath, hosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(derivations) != len(hosts) {
+		return nil, nil, fmt.Errorf("Expected %d derivations, got %d", len(hosts), len(derivations))
+	}
+
+	for index, host := range hosts {
+		system, err := ctx.nixStoreQuery("", "--outputs", derivations[index])
+		if err != nil {
+			return nil, nil, err
+		}
+		system = strings.TrimSpace(system)
+		systems = append(systems, system)
+
+		if err = os.Symlink(derivations[index], filepath.Join(resultPath, host.Name+".drv")); err != nil {
+			return nil, nil, err
+		}
+		if err = os.Symlink(system, filepath.Join(resultPath, host.Name)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return derivations, systems, nil
+}
+
+// Returns the build host, as a host morph can connect to
+func (ctx *NixContext) buildHost() Host {
+	user, hostname, hasUser := strings.Cut(ctx.BuildHost, "@")
+	if !hasUser {
+		user, hostname = "", ctx.BuildHost
+	}
+	return Host{Name: ctx.BuildHost, TargetHost: hostname, TargetUser: user}
+}
+
+// Builds the systems of the hosts on the build host: the systems are instantiated locally, and their derivations are
+// copied to the build host and realised there. Unless ctx.CopyFromBuildHost is set, the systems stay on the build host,
+// to be pushed from there (see Push).
+func (ctx *NixContext) buildOnBuildHost(deploymentPath string, hosts []Host, resultPath string, roots map[string]string) error {
+	buildHost := ctx.buildHost()
+
+	derivations, systems, err := ctx.instantiateMachines(deploymentPath, hosts, resultPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Copying derivations to the build host %s\n", ctx.BuildHost)
+	if err = ctx.backend().Push(ctx.SSHContext, buildHost, derivations...); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Building on %s:\n", ctx.BuildHost)
+	if err = ctx.SSHContext.Realise(&buildHost, derivations, mkOptions(hosts[0].NixConfig)...); err != nil {
+		return err
+	}
+
+	if !ctx.CopyFromBuildHost {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Copying systems from the build host %s\n", ctx.BuildHost)
+	if err = ctx.backend().Pull(ctx.SSHContext, buildHost, systems...); err != nil {
+		return err
+	}
+	for index, host := range hosts {
+		roots[host.Name] = systems[index]
+	}
+	return nil
+}
+
+// Splits hosts into groups with identical nix options, keeping the order of the hosts
+func groupByNixConfig(hosts []Host) (groups [][]Host) {
+	indices := make(map[string]int)
+	for _, host := range hosts {
+		// maps are marshalled with sorted keys
+		key, _ := json.Marshal(host.NixConfig)
+		if len(host.NixConfig) == 0 {
+			key = []byte("{}")
+		}
+		index, ok := indices[string(key)]
+		if !ok {
+			index = len(groups)
+			indices[string(key)] = index
+			groups = append(groups, nil)
+		}
+		groups[index] = append(groups[index], host)
+	}
+	return groups
+}
+
+func describeNixConfig(nixConfig map[string]string) string {
+	if len(nixConfig) == 0 {
+		return "none"
+	}
+
+	options := make([]string, 0)
+	for name, value := range nixConfig {
+		options = append(options, name+"="+value)
+	}
+	sort.Strings(options)
+	return strings.Join(options, " ")
+}
+
+// Pushes the paths to the host; from the build host, if they were built there and not copied to this machine
+func (ctx *NixContext) Push(sshContext *ssh.SSHContext, host Host, paths ...string) error {
+	if ctx.BuildHost != "" && !ctx.CopyFromBuildHost && !host.BuildOnTarget {
+		buildHost := ctx.buildHost()
+		return sshContext.CopyClosure(&buildHost, &host, paths, host.SubstituteOnDestination)
+	}
+	return ctx.backend().Push(sshContext, host, paths...)
+}
+
+func (ctx *legacyBackend) Push(sshContext *ssh.SSHContext, host Host, paths ...string) error {
+	return Push(sshContext, host, paths...)
+}
+
+func (ctx *legacyBackend) Pull(sshContext *ssh.SSHContext, host Host, paths ...string) error {
+	store, env := sshStore(sshContext, host)
+
+	cmd := exec.Command("nix-copy-closure", append([]string{"--from", store}, paths...)...)
+	cmd.Env = env
+
+	cmd.Stdout = sshContext.Stderr()
+	cmd.Stderr = sshContext.Stderr()
+	return cmd.Run()
+}
@@ -0,0 +1,273 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/DBCDK/morph/ssh"
+)
+
+type PackageChange struct {
+	Name        string
+	OldVersions []string
+	NewVersions []string
+	SizeDelta   int64
+}
+
+type ClosureDiff struct {
+	Added     []PackageChange
+	Removed   []PackageChange
+	Changed   []PackageChange
+	SizeDelta int64
+}
+
+func (diff *ClosureDiff) IsEmpty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0 && diff.SizeDelta == 0
+}
+
+// Compare the closure of the configuration currently running on the host, with the closure of a locally built
+// configuration. Like `nix store diff-closures`, paths are grouped into packages by name, and a package is
+// reported as changed when its set of versions differ.
+func (ctx *NixContext) DiffSystemClosure(sshContext *ssh.SSHContext, host Host, configuration string) (diff ClosureDiff, err error) {
+	current, err := sshContext.GetCurrentSystem(&host)
+	if err != nil {
+		return diff, err
+	}
+
+	oldClosure, err := sshContext.GetClosure(&host, current)
+	if err != nil {
+		return diff, err
+	}
+
+	newClosure, err := ctx.getClosure(configuration)
+	if err != nil {
+		return diff, err
+	}
+
+	removedPaths := difference(oldClosure, newClosure)
+	addedPaths := difference(newClosure, oldClosure)
+
+	sizes := make(map[string]int64)
+	if err = addSizes(sizes, removedPaths, func(paths []string) ([]int64, error) {
+		return sshContext.GetPathSizes(&host, paths)
+	}); err != nil {
+		return diff, err
+	}
+	if err = addSizes(sizes, addedPaths, ctx.getPathSizes); err != nil {
+		return diff, err
+	}
+
+	oldPackages := groupByPackage(removedPaths)
+	newPackages := groupByPackage(addedPaths)
+
+	names := make(map[string]bool)
+	for name := range oldPackages {
+		names[name] = true
+	}
+	for name := range newPackages {
+		names[name] = true
+	}
+
+	for name := range names {
+		change := PackageChange{Name: name}
+		for version, paths := range oldPackages[name] {
+			change.OldVersions = append(change.OldVersions, version)
+			for _, path := range paths {
+				change.SizeDelta -= sizes[path]
+			}
+		}
+		for version, paths := range newPackages[name] {
+			change.NewVersions = append(change.NewVersions, version)
+			for _, path := range paths {
+				change.SizeDelta += sizes[path]
+			}
+		}
+		sort.Strings(change.OldVersions)
+		sort.Strings(change.NewVersions)
+		diff.SizeDelta += change.SizeDelta
+
+		switch {
+		case len(change.OldVersions) == 0:
+			diff.Added = append(diff.Added, change)
+		case len(change.NewVersions) == 0:
+			diff.Removed = append(diff.Removed, change)
+		case strings.Join(change.OldVersions, ",") != strings.Join(change.NewVersions, ","):
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+
+	for _, changes := range [][]PackageChange{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+
+	return diff, nil
+}
+
+func PrintClosureDiff(out io.Writer, diff ClosureDiff) {
+	if diff.IsEmpty() {
+		fmt.Fprintln(out, "\tNo changes")
+		return
+	}
+
+	printChanges := func(title string, changes []PackageChange) {
+		if len(changes) == 0 {
+			return
+		}
+		fmt.Fprintf(out, "\t%s:\n", title)
+		for _, change := range changes {
+			fmt.Fprintf(out, "\t\t%s: %s → %s, %s\n", change.Name,
+				formatVersions(change.OldVersions), formatVersions(change.NewVersions), formatSize(change.SizeDelta))
+		}
+	}
+
+	printChanges("Added", diff.Added)
+	printChanges("Removed", diff.Removed)
+	printChanges("Changed", diff.Changed)
+
+	fmt.Fprintf(out, "\tClosure size: %s\n", formatSize(diff.SizeDelta))
+}
+
+func formatVersions(versions []string) string {
+	if len(versions) == 0 {
+		return "∅"
+	}
+
+	formatted := make([]string, 0)
+	for _, version := range versions {
+		if version == "" {
+			version = "ε"
+		}
+		formatted = append(formatted, version)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func formatSize(size int64) string {
+	sign := "+"
+	if size < 0 {
+		sign = "-"
+		size = -size
+	}
+
+	value := float64(size)
+	for _, unit := range []string{"B", "KiB", "MiB"} {
+		if value < 1024 {
+			return fmt.Sprintf("%s%.1f %s", sign, value, unit)
+		}
+		value /= 1024
+	}
+	return fmt.Sprintf("%s%.1f GiB", sign, value)
+}
+
+// Split a store path into package name and version, the same way Nix splits derivation names:
+// the version starts at the first dash followed by a digit.
+func parseStorePathName(path string) (name string, version string) {
+	base := filepath.Base(path)
+	// strip the hash
+	if index := strings.IndexByte(base, '-'); index >= 0 {
+		base = base[index+1:]
+	}
+
+	for index := 0; index < len(base)-1; index++ {
+		if base[index] == '-' && unicode.IsDigit(rune(base[index+1])) {
+			return base[:index], base[index+1:]
+		}
+	}
+
+	return base, ""
+}
+
+// Group store paths by package name and version
+func groupByPackage(paths []string) map[string]map[string][]string {
+	packages := make(map[string]map[string][]string)
+	for _, path := range paths {
+		name, version := parseStorePathName(path)
+		if packages[name] == nil {
+			packages[name] = make(map[string][]string)
+		}
+		packages[name][version] = append(packages[name][version], path)
+	}
+	return packages
+}
+
+// Returns the paths in a, which aren't in b
+func difference(a []string, b []string) (paths []string) {
+	inB := make(map[string]bool)
+	for _, path := range b {
+		inB[path] = true
+	}
+
+	for _, path := range a {
+		if !inB[path] {
+			paths = append(paths, path)
+		}
+	}
+	return
+}
+
+func addSizes(sizes map[string]int64, paths []string, getSizes func([]string) ([]int64, error)) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	pathSizes, err := getSizes(paths)
+	if err != nil {
+		return err
+	}
+
+	for index, path := range paths {
+		sizes[path] = pathSizes[index]
+	}
+	return nil
+}
+
+func (ctx *NixContext) getClosure(path string) ([]string, error) {
+	output, err := ctx.nixStoreQuery("", "--requisites", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(output), nil
+}
+
+// Like SSHContext.GetPathSizes, the paths are passed to nix-store by xargs
+func (ctx *NixContext) getPathSizes(paths []string) ([]int64, error) {
+	output, err := ctx.nixStoreQuery(strings.Join(paths, "\n"), "--size")
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParseSizes(output, len(paths))
+}
+
+// Runs `nix-store --query`; through xargs, with the rest of the arguments on stdin, unless input is empty
+func (ctx *NixContext) nixStoreQuery(input string, args ...string) (string, error) {
+	args = append([]string{"--query"}, args...)
+
+	var cmd *exec.Cmd
+	if input != "" {
+		cmd = exec.Command("xargs", append([]string{ctx.StoreCmd}, args...)...)
+		cmd.Stdin = strings.NewReader(input)
+	} else {
+		cmd = exec.Command(ctx.StoreCmd, args...)
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error while running `%s`: %s", cmd.String(), err.Error()))
+	}
+
+	return stdout.String(), nil
+}
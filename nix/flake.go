@@ -0,0 +1,71 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A deployment given as an output of a flake, e.g. .#prod for the `morph.prod` output of the flake in the current
+// directory. The output is the result of the flake calling morph's `lib.deployment`.
+type Flake struct {
+	Ref  string
+	Name string
+}
+
+// Returns the flake a deployment refers to, unless the deployment is a file
+func ParseFlake(deployment string) (*Flake, bool) {
+	if _, err := os.Stat(deployment); err == nil {
+		return nil, false
+	}
+
+	ref, name, ok := strings.Cut(deployment, "#")
+	if !ok || name == "" {
+		return nil, false
+	}
+	if ref == "" {
+		ref = "."
+	}
+
+	return &Flake{Ref: ref, Name: name}, true
+}
+
+func (flake *Flake) String() string {
+	return flake.Ref + "#" + flake.Name
+}
+
+// Returns the directory of a flake on the local file system, or "" for e.g. github: flakes
+func (flake *Flake) Dir() string {
+	ref := flake.Ref
+	for _, prefix := range []string{"path:", "git+file://"} {
+		ref = strings.TrimPrefix(ref, prefix)
+	}
+	// drop parameters such as ?dir=...
+	ref, _, _ = strings.Cut(ref, "?")
+	if strings.Contains(ref, ":") {
+		return ""
+	}
+	return ref
+}
+
+// Returns the flake with its local directory (if any) made absolute, so it refers to the same flake from anywhere
+func (flake *Flake) Abs() (*Flake, error) {
+	dir := flake.Dir()
+	if dir == "" {
+		return flake, nil
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Flake{Ref: strings.Replace(flake.Ref, dir, absDir, 1), Name: flake.Name}, nil
+}
+
+func (flake *Flake) installable(attr string) string {
+	return fmt.Sprintf("%s#morph.%s.%s", flake.Ref, flake.Name, attr)
+}
+
+// Arguments given to all invocations of the nix command, since flakes and the nix command are experimental features
+var flakeArgs = []string{"--extra-experimental-features", "nix-command flakes"}
@@ -0,0 +1,189 @@
+package nix
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When a host may be activated or rebooted (deployment.maintenanceWindow)
+type MaintenanceWindow struct {
+	Days     []string
+	Hours    []string
+	Timezone string
+}
+
+// A parsed MaintenanceWindow
+type window struct {
+	days     [7]bool
+	hours    []hourRange
+	location *time.Location
+}
+
+// minutes since midnight; end is exclusive, and before start if the range crosses midnight
+type hourRange struct {
+	start int
+	end   int
+}
+
+// abbreviations of the days of the week, in the order of time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (w *MaintenanceWindow) String() string {
+	days := "every day"
+	if len(w.Days) > 0 {
+		days = strings.Join(w.Days, ",")
+	}
+	hours := "all day"
+	if len(w.Hours) > 0 {
+		hours = strings.Join(w.Hours, ",")
+	}
+	return fmt.Sprintf("%s %s (%s)", days, hours, w.timezone())
+}
+
+func (w *MaintenanceWindow) timezone() string {
+	if w.Timezone == "" {
+		return "UTC"
+	}
+	return w.Timezone
+}
+
+// Returns an error if the days, hours or time zone of the window are invalid
+func (w *MaintenanceWindow) Validate() error {
+	_, err := w.parse()
+	return err
+}
+
+func (w *MaintenanceWindow) parse() (parsed window, err error) {
+	parsed.location, err = time.LoadLocation(w.timezone())
+	if err != nil {
+		return parsed, fmt.Errorf("Invalid maintenance window time zone: %s", err)
+	}
+
+	if len(w.Days) == 0 {
+		for day := range parsed.days {
+			parsed.days[day] = true
+		}
+	}
+	for _, days := range w.Days {
+		first, last, isRange := strings.Cut(days, "-")
+		if !isRange {
+			last = first
+		}
+		start, err := parseWeekday(first)
+		if err != nil {
+			return parsed, err
+		}
+		end, err := parseWeekday(last)
+		if err != nil {
+			return parsed, err
+		}
+		// ranges may wrap around the end of the week, e.g. Fri-Mon
+		for day := start; ; day = (day + 1) % 7 {
+			parsed.days[day] = true
+			if day == end {
+				break
+			}
+		}
+	}
+
+	if len(w.Hours) == 0 {
+		parsed.hours = []hourRange{{start: 0, end: 24 * 60}}
+	}
+	for _, hours := range w.Hours {
+		first, last, isRange := strings.Cut(hours, "-")
+		if !isRange {
+			return parsed, fmt.Errorf("Invalid maintenance window hours %q: expected HH:MM-HH:MM", hours)
+		}
+		start, err := parseTimeOfDay(first)
+		if err != nil {
+			return parsed, err
+		}
+		end, err := parseTimeOfDay(last)
+		if err != nil {
+			return parsed, err
+		}
+		if start == end {
+			return parsed, fmt.Errorf("Invalid maintenance window hours %q: the range is empty", hours)
+		}
+		parsed.hours = append(parsed.hours, hourRange{start: start, end: end})
+	}
+
+	return parsed, nil
+}
+
+func parseWeekday(day string) (time.Weekday, error) {
+	name := strings.ToLower(strings.TrimSpace(day))
+	for index, weekday := range weekdays {
+		if name == weekday || name == strings.ToLower(time.Weekday(index).String()) {
+			return time.Weekday(index), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid maintenance window day: %q", day)
+}
+
+// Returns the minutes since midnight of HH:MM (24:00 being the end of the day)
+func parseTimeOfDay(timeOfDay string) (int, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(timeOfDay), ":")
+	h, hErr := strconv.Atoi(hours)
+	m, mErr := strconv.Atoi(minutes)
+	if !ok || hErr != nil || mErr != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("Invalid maintenance window time: %q", timeOfDay)
+	}
+	return h*60 + m, nil
+}
+
+// Returns whether the window is open at t
+func (w *MaintenanceWindow) Contains(t time.Time) (bool, error) {
+	parsed, err := w.parse()
+	if err != nil {
+		return false, err
+	}
+	return parsed.contains(t), nil
+}
+
+func (parsed window) contains(t time.Time) bool {
+	t = t.In(parsed.location)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, hours := range parsed.hours {
+		if hours.start < hours.end {
+			if parsed.days[today] && minute >= hours.start && minute < hours.end {
+				return true
+			}
+			continue
+		}
+		// the range crosses midnight, and belongs to the day it starts on
+		if parsed.days[today] && minute >= hours.start {
+			return true
+		}
+		if parsed.days[yesterday] && minute < hours.end {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first time (to the minute) at or after t the window is open
+func (w *MaintenanceWindow) NextOpening(t time.Time) (time.Time, error) {
+	parsed, err := w.parse()
+	if err != nil {
+		return t, err
+	}
+	if parsed.contains(t) {
+		return t, nil
+	}
+
+	// every window opens within a week
+	next := t.Truncate(time.Minute)
+	for i := 0; i <= 8*24*60; i++ {
+		next = next.Add(time.Minute)
+		if parsed.contains(next) {
+			return next, nil
+		}
+	}
+	return t, fmt.Errorf("The maintenance window %s never opens", w)
+}
@@ -0,0 +1,120 @@
+package nix
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// 2024-01-01 is a Monday
+func at(day int, hour int, minute int, location string) time.Time {
+	loc, err := time.LoadLocation(location)
+	if err != nil {
+		panic(err)
+	}
+	return time.Date(2024, 1, day, hour, minute, 0, 0, loc)
+}
+
+func TestMaintenanceWindowValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		window MaintenanceWindow
+		valid  bool
+	}{
+		{"empty", MaintenanceWindow{}, true},
+		{"day names", MaintenanceWindow{Days: []string{"Mon", "tuesday", "Fri-Mon"}}, true},
+		{"hours", MaintenanceWindow{Hours: []string{"22:00-24:00", "00:00-06:30"}}, true},
+		{"time zone", MaintenanceWindow{Timezone: "Europe/Copenhagen"}, true},
+		{"unknown day", MaintenanceWindow{Days: []string{"Mon-Funday"}}, false},
+		{"single hour", MaintenanceWindow{Hours: []string{"22:00"}}, false},
+		{"empty hours", MaintenanceWindow{Hours: []string{"10:00-10:00"}}, false},
+		{"invalid minutes", MaintenanceWindow{Hours: []string{"10:60-11:00"}}, false},
+		{"past midnight", MaintenanceWindow{Hours: []string{"22:00-24:01"}}, false},
+		{"unknown time zone", MaintenanceWindow{Timezone: "Mars/Olympus_Mons"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.window.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected %s to be valid, got %s", test.name, &test.window, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected %s to be invalid", test.name, &test.window)
+		}
+	}
+}
+
+func TestMaintenanceWindowContains(t *testing.T) {
+	tests := []struct {
+		name   string
+		window MaintenanceWindow
+		time   time.Time
+		open   bool
+	}{
+		{"always open", MaintenanceWindow{}, at(3, 12, 0, "UTC"), true},
+		{"on the day", MaintenanceWindow{Days: []string{"Wed"}}, at(3, 12, 0, "UTC"), true},
+		{"another day", MaintenanceWindow{Days: []string{"Wed"}}, at(4, 12, 0, "UTC"), false},
+		{"start is inclusive", MaintenanceWindow{Hours: []string{"02:00-04:00"}}, at(3, 2, 0, "UTC"), true},
+		{"end is exclusive", MaintenanceWindow{Hours: []string{"02:00-04:00"}}, at(3, 4, 0, "UTC"), false},
+		{"end of day", MaintenanceWindow{Hours: []string{"22:00-24:00"}}, at(3, 23, 59, "UTC"), true},
+
+		// Fri-Mon wraps around the end of the week
+		{"wrapped range, first day", MaintenanceWindow{Days: []string{"Fri-Mon"}}, at(5, 12, 0, "UTC"), true},
+		{"wrapped range, sunday", MaintenanceWindow{Days: []string{"Fri-Mon"}}, at(7, 12, 0, "UTC"), true},
+		{"wrapped range, last day", MaintenanceWindow{Days: []string{"Fri-Mon"}}, at(8, 12, 0, "UTC"), true},
+		{"wrapped range, after", MaintenanceWindow{Days: []string{"Fri-Mon"}}, at(9, 12, 0, "UTC"), false},
+		{"wrapped range, before", MaintenanceWindow{Days: []string{"Fri-Mon"}}, at(4, 12, 0, "UTC"), false},
+
+		// a range crossing midnight belongs to the day it starts on
+		{"across midnight, evening", MaintenanceWindow{Days: []string{"Sat"}, Hours: []string{"22:00-02:00"}}, at(6, 23, 0, "UTC"), true},
+		{"across midnight, next morning", MaintenanceWindow{Days: []string{"Sat"}, Hours: []string{"22:00-02:00"}}, at(7, 1, 59, "UTC"), true},
+		{"across midnight, end", MaintenanceWindow{Days: []string{"Sat"}, Hours: []string{"22:00-02:00"}}, at(7, 2, 0, "UTC"), false},
+		{"across midnight, morning of the day", MaintenanceWindow{Days: []string{"Sat"}, Hours: []string{"22:00-02:00"}}, at(6, 1, 0, "UTC"), false},
+		{"across midnight, evening of the next day", MaintenanceWindow{Days: []string{"Sat"}, Hours: []string{"22:00-02:00"}}, at(7, 23, 0, "UTC"), false},
+
+		// the window is in its own time zone, regardless of the time zone of t
+		{"time zone, open", MaintenanceWindow{Hours: []string{"02:00-04:00"}, Timezone: "Europe/Copenhagen"}, at(3, 1, 30, "UTC"), true},
+		{"time zone, closed", MaintenanceWindow{Hours: []string{"02:00-04:00"}, Timezone: "Europe/Copenhagen"}, at(3, 3, 30, "UTC"), false},
+		{"time zone, day", MaintenanceWindow{Days: []string{"Tue"}, Timezone: "America/New_York"}, at(3, 2, 0, "UTC"), true},
+		{"time zone, t elsewhere", MaintenanceWindow{Hours: []string{"02:00-04:00"}}, at(3, 4, 30, "Europe/Copenhagen"), true},
+	}
+
+	for _, test := range tests {
+		open, err := test.window.Contains(test.time)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if open != test.open {
+			t.Errorf("%s: expected %s to be open at %s: %t, got %t", test.name, &test.window, test.time, test.open, open)
+		}
+	}
+}
+
+func TestMaintenanceWindowNextOpening(t *testing.T) {
+	tests := []struct {
+		name   string
+		window MaintenanceWindow
+		time   time.Time
+		next   time.Time
+	}{
+		{"open now", MaintenanceWindow{Hours: []string{"02:00-04:00"}}, at(3, 3, 15, "UTC"), at(3, 3, 15, "UTC")},
+		{"later today", MaintenanceWindow{Hours: []string{"02:00-04:00"}}, at(3, 1, 15, "UTC"), at(3, 2, 0, "UTC")},
+		{"tomorrow", MaintenanceWindow{Hours: []string{"02:00-04:00"}}, at(3, 4, 0, "UTC"), at(4, 2, 0, "UTC")},
+		{"next week", MaintenanceWindow{Days: []string{"Mon"}}, at(2, 0, 0, "UTC"), at(8, 0, 0, "UTC")},
+		{"wrapped range", MaintenanceWindow{Days: []string{"Fri-Mon"}}, at(2, 12, 0, "UTC"), at(5, 0, 0, "UTC")},
+		{"across midnight", MaintenanceWindow{Days: []string{"Sat"}, Hours: []string{"22:00-02:00"}}, at(7, 2, 0, "UTC"), at(13, 22, 0, "UTC")},
+		{"time zone", MaintenanceWindow{Hours: []string{"02:00-04:00"}, Timezone: "Europe/Copenhagen"}, at(3, 12, 0, "UTC"), at(4, 1, 0, "UTC")},
+	}
+
+	for _, test := range tests {
+		next, err := test.window.NextOpening(test.time)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !next.Equal(test.next) {
+			t.Errorf("%s: expected %s to open next at %s, got %s", test.name, &test.window, test.next, next)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -12,9 +13,10 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
-	"time"
 
+	"github.com/DBCDK/morph/events"
 	"github.com/DBCDK/morph/healthchecks"
+	"github.com/DBCDK/morph/hooks"
 	"github.com/DBCDK/morph/secrets"
 	"github.com/DBCDK/morph/ssh"
 	"github.com/DBCDK/morph/utils"
@@ -23,6 +25,7 @@ import (
 type Host struct {
 	PreDeployChecks         healthchecks.HealthChecks
 	HealthChecks            healthchecks.HealthChecks
+	Hooks                   hooks.Hooks
 	Name                    string
 	NixosRelease            string
 	TargetHost              string
@@ -31,17 +34,35 @@ type Host struct {
 	Secrets                 map[string]secrets.Secret
 	BuildOnly               bool
 	SubstituteOnDestination bool
+	BuildOnTarget           bool
+	RevertOnBoot            bool
 	NixConfig               map[string]string
 	Tags                    []string
+	MaintenanceWindow       *MaintenanceWindow
 }
 
 type HostOrdering struct {
 	Tags []string
 }
 
+type RolloutWave struct {
+	Tags  []string
+	Pause int
+}
+
+type Rollout struct {
+	Waves []RolloutWave
+}
+
 type DeploymentMetadata struct {
-	Description string
-	Ordering    HostOrdering
+	Description   string
+	Ordering      HostOrdering
+	Rollout       Rollout
+	Hooks         hooks.Hooks
+	Webhooks      []events.Webhook
+	ProtectedTags []string
+	NixBackend    string
+	BuildHost     string
 }
 
 type Deployment struct {
@@ -50,13 +71,22 @@ type Deployment struct {
 }
 
 type NixContext struct {
-	EvalCmd         string
-	BuildCmd        string
-	ShellCmd        string
+	EvalCmd  string
+	BuildCmd string
+	ShellCmd string
+	NixCmd   string
+	StoreCmd string
+	// LegacyBackend or NixCLIBackend
+	Backend         string
 	EvalMachines    string
 	ShowTrace       bool
 	KeepGCRoot      bool
 	AllowBuildShell bool
+	// The machine ([user@]host) the systems are built on, if not locally (see BuildMachines)
+	BuildHost string
+	// Whether systems built on the build host are copied to this machine, rather than pushed from the build host
+	CopyFromBuildHost bool
+	SSHContext        *ssh.SSHContext
 }
 
 type NixBuildInvocationArgs struct {
@@ -98,6 +128,35 @@ func (nArgs *NixBuildInvocationArgs) ToNixBuildArgs() []string {
 	return args
 }
 
+// Like ToNixBuildArgs, but for `nix build`
+func (nArgs *NixBuildInvocationArgs) ToNixCLIBuildArgs() []string {
+	args := []string{
+		"build",
+		"--file", nArgs.NixContext.EvalMachines,
+		"--arg", "networkExpr", nArgs.DeploymentPath,
+		"--argstr", "argsFile", nArgs.ArgsFile,
+		"--out-link", nArgs.ResultLinkPath,
+	}
+	args = append(args, flakeArgs...)
+
+	args = append(args, mkOptions(nArgs.NixConfig)...)
+
+	if len(nArgs.NixArgs) > 0 {
+		args = append(args, nArgs.NixArgs...)
+	}
+
+	if nArgs.NixContext.ShowTrace {
+		args = append(args, "--show-trace")
+	}
+
+	if nArgs.NixBuildTargets != "" {
+		args = append(args,
+			"--arg", "buildTargets", nArgs.NixBuildTargets)
+	}
+
+	return append(args, nArgs.Attr)
+}
+
 func (nArgs *NixEvalInvocationArgs) ToNixInstantiateArgs() []string {
 	args := []string{
 		"--eval", nArgs.NixContext.EvalMachines,
@@ -163,73 +222,13 @@ func (host *Host) GetTags() []string {
 	return host.Tags
 }
 
-func (host *Host) Reboot(sshContext *ssh.SSHContext) error {
-
-	var (
-		oldBootID string
-		newBootID string
-	)
-
-	oldBootID, err := sshContext.GetBootID(host)
-	// If the host doesn't support getting boot ID's for some reason, warn about it, and skip the comparison
-	skipBootIDComparison := err != nil
-	if skipBootIDComparison {
-		fmt.Fprintf(os.Stderr, "Error getting boot ID (this is used to determine when the reboot is complete): %v\n", err)
-		fmt.Fprintf(os.Stderr, "This makes it impossible to detect when the host has rebooted, so health checks might pass before the host has rebooted.\n")
-	}
-
-	if cmd, err := sshContext.Cmd(host, "sudo", "reboot"); cmd != nil {
-		fmt.Fprint(os.Stderr, "Asking host to reboot ... ")
-		if err = cmd.Run(); err != nil {
-			// Here we assume that exit code 255 means: "SSH connection got disconnected",
-			// which is OK for a reboot - sshd may close active connections before we disconnect after all
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 255 {
-					fmt.Fprintln(os.Stderr, "Remote host disconnected.")
-					err = nil
-				}
-			}
-		}
-
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "Failed")
-			return err
-		}
-	}
-
-	fmt.Fprintln(os.Stderr, "OK")
-
-	if !skipBootIDComparison {
-		fmt.Fprint(os.Stderr, "Waiting for host to come online ")
-
-		// Wait for the host to get a new boot ID. These ID's should be unique for each boot,
-		// meaning a reboot will have been completed when the boot ID has changed.
-		for {
-			fmt.Fprint(os.Stderr, ".")
-
-			// Ignore errors; there'll be plenty of them since we'll be attempting to connect to an offline host,
-			// and we know from previously that the host should support boot ID's
-			newBootID, _ = sshContext.GetBootID(host)
-
-			if newBootID != "" && oldBootID != newBootID {
-				fmt.Fprintln(os.Stderr, " OK")
-				break
-			}
-
-			time.Sleep(2 * time.Second)
-		}
-	}
-
-	return nil
-}
-
-func (ctx *NixContext) GetBuildShell(deploymentPath string) (buildShell *string, err error) {
+func (ctx *legacyBackend) getBuildShell(deploymentPath string) (buildShell *string, err error) {
 
 	nixEvalInvocationArgs := NixEvalInvocationArgs{
 		AsJSON:         true,
 		Attr:           "info.buildShell",
 		DeploymentPath: deploymentPath,
-		NixContext:     *ctx,
+		NixContext:     *ctx.NixContext,
 		Strict:         true,
 	}
 
@@ -267,14 +266,14 @@ func (ctx *NixContext) GetBuildShell(deploymentPath string) (buildShell *string,
 	return buildShell, nil
 }
 
-func (ctx *NixContext) EvalHosts(deploymentPath string, attr string) (string, error) {
+func (ctx *legacyBackend) EvalHosts(deploymentPath string, attr string, out io.Writer) (string, error) {
 	attribute := "nodes." + attr
 
 	nixEvalInvocationArgs := NixEvalInvocationArgs{
 		AsJSON:         false,
 		Attr:           attribute,
 		DeploymentPath: deploymentPath,
-		NixContext:     *ctx,
+		NixContext:     *ctx.NixContext,
 		Strict:         true,
 	}
 
@@ -291,7 +290,7 @@ func (ctx *NixContext) EvalHosts(deploymentPath string, attr string) (string, er
 		}
 	})
 
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = out
 	cmd.Stderr = os.Stderr
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, fmt.Sprintf("MORPH_ARGS=%s", jsonArgs))
@@ -299,13 +298,44 @@ func (ctx *NixContext) EvalHosts(deploymentPath string, attr string) (string, er
 	return deploymentPath, err
 }
 
-func (ctx *NixContext) GetMachines(deploymentPath string) (deployment Deployment, err error) {
+func (ctx *legacyBackend) InstantiateMachines(deploymentPath string, hosts []Host) ([]string, error) {
+	args := []string{ctx.EvalMachines, "--arg", "networkExpr", deploymentPath}
+	for _, host := range hosts {
+		args = append(args, "--attr", fmt.Sprintf("nodes.%q.config.system.build.toplevel", host.Name))
+	}
+	if ctx.ShowTrace {
+		args = append(args, "--show-trace")
+	}
+
+	cmd := exec.Command(ctx.EvalCmd, args...)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	utils.AddFinalizer(func() {
+		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		}
+	})
+	err := cmd.Run()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error while running `%s ..`: %s", ctx.EvalCmd, err.Error(),
+		)
+		return nil, errors.New(errorMessage)
+	}
+
+	return strings.Fields(stdout.String()), nil
+}
+
+func (ctx *legacyBackend) GetMachines(deploymentPath string) (deployment Deployment, err error) {
 
 	nixEvalInvocationArgs := NixEvalInvocationArgs{
 		AsJSON:         true,
 		Attr:           "info.deployment",
 		DeploymentPath: deploymentPath,
-		NixContext:     *ctx,
+		NixContext:     *ctx.NixContext,
 		Strict:         true,
 	}
 
@@ -343,10 +373,11 @@ func (ctx *NixContext) GetMachines(deploymentPath string) (deployment Deployment
 	return deployment, nil
 }
 
-func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArgs []string, nixBuildTargets string) (resultPath string, err error) {
+// Writes the arguments of building hosts to a temporary file, read by eval-machines.nix
+func (ctx *NixContext) buildInvocation(deploymentPath string, hosts []Host, nixArgs []string, nixBuildTargets string) (invocation NixBuildInvocationArgs, jsonArgs []byte, err error) {
 	tmpdir, err := ioutil.TempDir("", "morph-")
 	if err != nil {
-		return "", err
+		return invocation, nil, err
 	}
 	utils.AddFinalizer(func() {
 		os.RemoveAll(tmpdir)
@@ -357,9 +388,16 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 		hostNames = append(hostNames, host.Name)
 	}
 
-	resultLinkPath := filepath.Join(path.Dir(deploymentPath), ".gcroots", path.Base(deploymentPath))
+	resultLinkPath := gcRootPath(deploymentPath)
 	if ctx.KeepGCRoot {
-		if err = os.MkdirAll(path.Dir(resultLinkPath), 0755); err != nil {
+		// the result of several builds is a directory (see keepResult), which the link replaces
+		if info, statErr := os.Lstat(resultLinkPath); statErr == nil && info.IsDir() {
+			err = os.RemoveAll(resultLinkPath)
+		}
+		if err == nil {
+			err = os.MkdirAll(path.Dir(resultLinkPath), 0755)
+		}
+		if err != nil {
 			ctx.KeepGCRoot = false
 			fmt.Fprintf(os.Stderr, "Unable to create GC root, skipping: %s", err)
 		}
@@ -369,17 +407,8 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 		resultLinkPath = filepath.Join(tmpdir, "result")
 	}
 
-	buildShell, err := ctx.GetBuildShell(deploymentPath)
-
-	if err != nil {
-		errorMessage := fmt.Sprintf(
-			"Error getting buildShell.",
-		)
-		return resultPath, errors.New(errorMessage)
-	}
-
 	argsFile := tmpdir + "/morph-args.json"
-	NixBuildInvocationArgs := NixBuildInvocationArgs{
+	invocation = NixBuildInvocationArgs{
 		ArgsFile:        argsFile,
 		Attr:            "machines",
 		DeploymentPath:  deploymentPath,
@@ -391,16 +420,34 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 		ResultLinkPath:  resultLinkPath,
 	}
 
-	jsonArgs, err := json.Marshal(NixBuildInvocationArgs)
+	jsonArgs, err = json.Marshal(invocation)
 	if err != nil {
-		return "", err
+		return invocation, nil, err
 	}
 
 	err = ioutil.WriteFile(argsFile, jsonArgs, 0644)
+	if err != nil {
+		return invocation, nil, err
+	}
+
+	return invocation, jsonArgs, nil
+}
+
+func (ctx *legacyBackend) BuildMachines(deploymentPath string, hosts []Host, nixArgs []string, nixBuildTargets string) (resultPath string, err error) {
+	NixBuildInvocationArgs, jsonArgs, err := ctx.buildInvocation(deploymentPath, hosts, nixArgs, nixBuildTargets)
 	if err != nil {
 		return "", err
 	}
 
+	buildShell, err := ctx.getBuildShell(deploymentPath)
+
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error getting buildShell.",
+		)
+		return resultPath, errors.New(errorMessage)
+	}
+
 	var cmd *exec.Cmd
 	if ctx.AllowBuildShell && buildShell != nil {
 
@@ -422,7 +469,7 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, fmt.Sprintf("MORPH_ARGS=%s", jsonArgs))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("MORPH_ARGS_FILE=%s", argsFile))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("MORPH_ARGS_FILE=%s", NixBuildInvocationArgs.ArgsFile))
 	err = cmd.Run()
 
 	if err != nil {
@@ -432,7 +479,7 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 		return resultPath, errors.New(errorMessage)
 	}
 
-	resultPath, err = os.Readlink(resultLinkPath)
+	resultPath, err = os.Readlink(NixBuildInvocationArgs.ResultLinkPath)
 	if err != nil {
 		return "", err
 	}
@@ -440,7 +487,7 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 	return
 }
 
-func mkOptionsFromHost(host Host) []string {
+func MkOptionsFromHost(host Host) []string {
 	return mkOptions(host.NixConfig)
 }
 
@@ -463,6 +510,15 @@ func GetNixSystemDerivation(host Host, resultPath string) (string, error) {
 }
 
 func GetPathsToPush(host Host, resultPath string) (paths []string, err error) {
+	// the host builds the system itself, so only its derivation is pushed
+	if host.BuildOnTarget {
+		derivation, err := GetNixSystemDerivation(host, resultPath)
+		if err != nil {
+			return paths, err
+		}
+		return []string{derivation}, nil
+	}
+
 	path1, err := GetNixSystemPath(host, resultPath)
 	if err != nil {
 		return paths, err
@@ -473,13 +529,14 @@ func GetPathsToPush(host Host, resultPath string) (paths []string, err error) {
 	return paths, nil
 }
 
-func Push(ctx *ssh.SSHContext, host Host, paths ...string) (err error) {
+// Returns the SSH store of a host (as in ssh://user@host), and the environment passing the SSH options to nix
+func sshStore(ctx *ssh.SSHContext, host Host) (store string, env []string) {
 	utils.ValidateEnvironment("ssh")
 
 	var userArg = ""
 	var keyArg = ""
 	var sshOpts = []string{}
-	var env = os.Environ()
+	env = os.Environ()
 	if host.TargetUser != "" {
 		userArg = host.TargetUser + "@"
 	} else if ctx.DefaultUsername != "" {
@@ -501,10 +558,16 @@ func Push(ctx *ssh.SSHContext, host Host, paths ...string) (err error) {
 		env = append(env, fmt.Sprintf("NIX_SSHOPTS=%s", strings.Join(sshOpts, " ")))
 	}
 
-	options := mkOptionsFromHost(host)
+	return userArg + host.TargetHost + keyArg, env
+}
+
+func Push(ctx *ssh.SSHContext, host Host, paths ...string) (err error) {
+	store, env := sshStore(ctx, host)
+
+	options := MkOptionsFromHost(host)
 	for _, path := range paths {
 		args := []string{
-			"--to", userArg + host.TargetHost + keyArg,
+			"--to", store,
 			path,
 		}
 		args = append(args, options...)
@@ -517,8 +580,8 @@ func Push(ctx *ssh.SSHContext, host Host, paths ...string) (err error) {
 		)
 		cmd.Env = env
 
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = ctx.Stderr()
+		cmd.Stderr = ctx.Stderr()
 		err = cmd.Run()
 
 		if err != nil {
@@ -0,0 +1,265 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/DBCDK/morph/events"
+	"github.com/DBCDK/morph/ssh"
+	"github.com/DBCDK/morph/utils"
+)
+
+// Returns an invocation of a nix subcommand (e.g. eval)
+func (ctx *nixCLIBackend) command(subcommand string, args ...string) *exec.Cmd {
+	args = append(append([]string{subcommand}, flakeArgs...), args...)
+	if ctx.ShowTrace {
+		args = append(args, "--show-trace")
+	}
+
+	return ctx.terminateOnExit(exec.Command(ctx.NixCmd, args...))
+}
+
+func (ctx *nixCLIBackend) terminateOnExit(cmd *exec.Cmd) *exec.Cmd {
+	utils.AddFinalizer(func() {
+		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		}
+	})
+	return cmd
+}
+
+// Returns the arguments selecting an attribute of a deployment: an attribute of a flake output, or of eval-machines.nix
+// called with a deployment file
+func (ctx *nixCLIBackend) installable(deploymentPath string, attr string) []string {
+	if flake, isFlake := ParseFlake(deploymentPath); isFlake {
+		return []string{flake.installable(attr)}
+	}
+	return []string{"--file", ctx.EvalMachines, "--arg", "networkExpr", deploymentPath, attr}
+}
+
+// Runs a nix command, passing its structured log (--log-format internal-json, including evaluation errors) on as
+// build-log events with --output=json
+func (ctx *nixCLIBackend) runLogged(cmd *exec.Cmd) error {
+	if !events.Streaming() {
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+
+	cmd.Args = append(cmd.Args, "--log-format", "internal-json")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var entry map[string]interface{}
+		if strings.HasPrefix(line, "@nix ") && json.Unmarshal([]byte(strings.TrimPrefix(line, "@nix ")), &entry) == nil {
+			events.Emit(events.Event{Event: events.BuildLog, Data: entry})
+			continue
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+
+	// e.g. a line too long for the buffer; the rest of the output must still be read, or nix blocks writing it
+	if err = scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't parse the log of `%s`: %s\n", ctx.NixCmd, err)
+		_, _ = io.Copy(os.Stderr, stderr)
+	}
+
+	return cmd.Wait()
+}
+
+func (ctx *nixCLIBackend) eval(deploymentPath string, attr string, value interface{}) error {
+	cmd := ctx.command("eval", append([]string{"--json"}, ctx.installable(deploymentPath, attr)...)...)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := ctx.runLogged(cmd)
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error while running `%s eval ..`: %s", ctx.NixCmd, err.Error(),
+		)
+		return errors.New(errorMessage)
+	}
+
+	return json.Unmarshal(stdout.Bytes(), value)
+}
+
+func (ctx *nixCLIBackend) GetMachines(deploymentPath string) (deployment Deployment, err error) {
+	err = ctx.eval(deploymentPath, "info.deployment", &deployment)
+	return deployment, err
+}
+
+func (ctx *nixCLIBackend) EvalHosts(deploymentPath string, attr string, out io.Writer) (string, error) {
+	cmd := ctx.command("eval", ctx.installable(deploymentPath, "nodes."+attr)...)
+	cmd.Stdout = out
+	return deploymentPath, ctx.runLogged(cmd)
+}
+
+func (ctx *nixCLIBackend) InstantiateMachines(deploymentPath string, hosts []Host) (derivations []string, err error) {
+	names := make([]string, 0)
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+	jsonNames, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+
+	apply := fmt.Sprintf("nodes: map (name: nodes.${name}.config.system.build.toplevel.drvPath) (builtins.fromJSON %s)", strconv.Quote(string(jsonNames)))
+	args := append([]string{"--json"}, ctx.installable(deploymentPath, "nodes")...)
+	cmd := ctx.command("eval", append(args, "--apply", apply)...)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err = ctx.runLogged(cmd)
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error while running `%s eval ..`: %s", ctx.NixCmd, err.Error(),
+		)
+		return nil, errors.New(errorMessage)
+	}
+
+	err = json.Unmarshal(stdout.Bytes(), &derivations)
+	return derivations, err
+}
+
+func (ctx *nixCLIBackend) BuildMachines(deploymentPath string, hosts []Host, nixArgs []string, nixBuildTargets string) (resultPath string, err error) {
+	if flake, isFlake := ParseFlake(deploymentPath); isFlake {
+		return ctx.buildFlakeMachines(flake, hosts, nixArgs, nixBuildTargets)
+	}
+
+	if ctx.AllowBuildShell {
+		var buildShell *string
+		if err = ctx.eval(deploymentPath, "info.buildShell", &buildShell); err != nil {
+			return "", err
+		}
+		if buildShell != nil {
+			return "", errors.New("network.buildShell isn't supported by the nix backend")
+		}
+	}
+
+	invocation, jsonArgs, err := ctx.buildInvocation(deploymentPath, hosts, nixArgs, nixBuildTargets)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := ctx.terminateOnExit(exec.Command(ctx.NixCmd, invocation.ToNixCLIBuildArgs()...))
+	cmd.Stdout = os.Stderr
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("MORPH_ARGS=%s", jsonArgs))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("MORPH_ARGS_FILE=%s", invocation.ArgsFile))
+
+	err = ctx.runLogged(cmd)
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error while running `%s ...`: See above.", cmd.String(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	return os.Readlink(invocation.ResultLinkPath)
+}
+
+// Builds the system of each host of a flake deployment. Like the result of eval-machines.nix, the returned result path
+// is a directory with a link to the system of each host.
+func (ctx *nixCLIBackend) buildFlakeMachines(flake *Flake, hosts []Host, nixArgs []string, nixBuildTargets string) (resultPath string, err error) {
+	if nixBuildTargets != "" {
+		return "", errors.New("--build-target and --build-target-file aren't supported for flake deployments")
+	}
+
+	linkDir, err := ioutil.TempDir("", "morph-")
+	if err != nil {
+		return "", err
+	}
+	utils.AddFinalizer(func() {
+		os.RemoveAll(linkDir)
+	})
+
+	args := []string{"--print-out-paths", "--no-link"}
+	for _, host := range hosts {
+		args = append(args, flake.installable(fmt.Sprintf("nodes.%q.config.system.build.toplevel", host.Name)))
+	}
+	args = append(args, mkOptions(hosts[0].NixConfig)...)
+	args = append(args, nixArgs...)
+
+	cmd := ctx.command("build", args...)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err = ctx.runLogged(cmd)
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error while running `%s ...`: See above.", cmd.String(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	// the out paths are printed in the order of the installables
+	paths := strings.Fields(stdout.String())
+	if len(paths) != len(hosts) {
+		return "", fmt.Errorf("Expected %d paths from `%s build`, got %d", len(hosts), ctx.NixCmd, len(paths))
+	}
+	roots := make(map[string]string)
+	for index, host := range hosts {
+		if err = os.Symlink(paths[index], filepath.Join(linkDir, host.Name)); err != nil {
+			return "", err
+		}
+		roots[host.Name] = paths[index]
+	}
+
+	return ctx.keepResult(linkDir, roots, gcRootPath(flake.String()))
+}
+
+// Copies the closures of paths to the host with `nix copy`, over the ssh-ng protocol
+func (ctx *nixCLIBackend) Push(sshContext *ssh.SSHContext, host Host, paths ...string) error {
+	store, env := sshStore(sshContext, host)
+
+	args := []string{"--to", "ssh-ng://" + store}
+	args = append(args, MkOptionsFromHost(host)...)
+	if host.SubstituteOnDestination {
+		args = append(args, "--substitute-on-destination")
+	}
+	args = append(args, paths...)
+
+	cmd := ctx.command("copy", args...)
+	cmd.Env = env
+
+	cmd.Stdout = sshContext.Stderr()
+	cmd.Stderr = sshContext.Stderr()
+	return cmd.Run()
+}
+
+func (ctx *nixCLIBackend) Pull(sshContext *ssh.SSHContext, host Host, paths ...string) error {
+	store, env := sshStore(sshContext, host)
+
+	// the paths were built on the host, so they aren't signed
+	args := append([]string{"--from", "ssh-ng://" + store, "--no-check-sigs"}, paths...)
+
+	cmd := ctx.command("copy", args...)
+	cmd.Env = env
+
+	cmd.Stdout = sshContext.Stderr()
+	cmd.Stderr = sshContext.Stderr()
+	return cmd.Run()
+}
@@ -0,0 +1,190 @@
+package nix
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/DBCDK/morph/ssh"
+)
+
+// How Reboot tells that a host is back after rebooting
+const (
+	// the boot ID of the host has changed
+	RebootWaitBootID = "boot-id"
+	// the host is reachable over SSH again, and has been up for less time than since the reboot
+	RebootWaitSSH = "ssh"
+	// the boot ID has changed, and a systemd target (RebootOptions.SystemdTarget) is active
+	RebootWaitSystemdTarget = "systemd-target"
+)
+
+type RebootOptions struct {
+	// How long to wait for the host to come back, 0 meaning forever
+	Timeout time.Duration
+	// One of RebootWaitBootID, RebootWaitSSH and RebootWaitSystemdTarget
+	WaitFor       string
+	SystemdTarget string
+	// If set, the store path of the system configuration the host must have booted into
+	ExpectedSystem string
+}
+
+type RebootTimeoutError struct {
+	Host    string
+	Timeout time.Duration
+	// what morph was waiting for
+	Waiting string
+}
+
+func (e *RebootTimeoutError) Error() string {
+	return fmt.Sprintf("%s didn't come back within %s after rebooting (waited for %s)", e.Host, e.Timeout, e.Waiting)
+}
+
+func (host *Host) Reboot(sshContext *ssh.SSHContext, options RebootOptions) error {
+
+	var (
+		oldBootID string
+		newBootID string
+	)
+
+	out := sshContext.Stderr()
+
+	waitFor := options.WaitFor
+	if waitFor == "" {
+		waitFor = RebootWaitBootID
+	}
+
+	// whether the boot ID tells that the host has rebooted, rather than it being reachable over SSH again
+	useBootID := waitFor != RebootWaitSSH
+	if useBootID {
+		var err error
+		oldBootID, err = sshContext.GetBootID(host)
+		// If the host doesn't support getting boot ID's for some reason, warn about it, and fall back to SSH reachability.
+		// A systemd target is still waited for afterwards.
+		if err != nil {
+			fmt.Fprintf(out, "Error getting boot ID (this is used to determine when the reboot is complete): %v\n", err)
+			fmt.Fprintf(out, "Waiting for the host to become reachable over SSH instead, so health checks might pass before the host has rebooted.\n")
+			useBootID = false
+		}
+	}
+
+	// without boot ID, the uptime tells whether the host has rebooted, if the host has /proc/uptime
+	hasUptime := false
+	if !useBootID {
+		_, err := sshContext.GetUptime(host)
+		hasUptime = err == nil
+	}
+
+	rebootTime := time.Now()
+	if cmd, err := sshContext.Cmd(host, "sudo", "reboot"); cmd != nil {
+		fmt.Fprint(out, "Asking host to reboot ... ")
+		if err = cmd.Run(); err != nil {
+			// Here we assume that exit code 255 means: "SSH connection got disconnected",
+			// which is OK for a reboot - sshd may close active connections before we disconnect after all
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 255 {
+					fmt.Fprintln(out, "Remote host disconnected.")
+					err = nil
+				}
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintln(out, "Failed")
+			return err
+		}
+	}
+
+	fmt.Fprintln(out, "OK")
+
+	var deadline time.Time
+	if options.Timeout > 0 {
+		deadline = time.Now().Add(options.Timeout)
+	}
+
+	fmt.Fprint(out, "Waiting for host to come online ")
+
+	if !useBootID {
+		// the host may not have gone down yet, so being reachable only counts once it has been up for less time than
+		// since it was asked to reboot. Without /proc/uptime, it has to be unreachable before being reachable counts,
+		// which may not be noticed if the host reboots quickly.
+		wentDown := false
+		online := waitUntil(out, deadline, func() bool {
+			if hasUptime {
+				uptime, err := sshContext.GetUptime(host)
+				return err == nil && uptime < time.Since(rebootTime)
+			}
+			if !sshContext.IsReachable(host) {
+				wentDown = true
+				return false
+			}
+			return wentDown
+		})
+		if !online {
+			fmt.Fprintln(out, " Timed out")
+			return &RebootTimeoutError{Host: host.Name, Timeout: options.Timeout, Waiting: "the host to be reachable over SSH"}
+		}
+	} else {
+		// Wait for the host to get a new boot ID. These ID's should be unique for each boot,
+		// meaning a reboot will have been completed when the boot ID has changed.
+		online := waitUntil(out, deadline, func() bool {
+			// Ignore errors; there'll be plenty of them since we'll be attempting to connect to an offline host,
+			// and we know from previously that the host should support boot ID's
+			newBootID, _ = sshContext.GetBootID(host)
+			return newBootID != "" && oldBootID != newBootID
+		})
+		if !online {
+			fmt.Fprintln(out, " Timed out")
+			return &RebootTimeoutError{Host: host.Name, Timeout: options.Timeout, Waiting: "a new boot ID"}
+		}
+	}
+
+	fmt.Fprintln(out, " OK")
+
+	if waitFor == RebootWaitSystemdTarget {
+		fmt.Fprintf(out, "Waiting for %s to be reached ", options.SystemdTarget)
+		reached := waitUntil(out, deadline, func() bool {
+			active, _ := sshContext.IsUnitActive(host, options.SystemdTarget)
+			return active
+		})
+		if !reached {
+			fmt.Fprintln(out, " Timed out")
+			return &RebootTimeoutError{Host: host.Name, Timeout: options.Timeout, Waiting: options.SystemdTarget}
+		}
+		fmt.Fprintln(out, " OK")
+	}
+
+	if options.ExpectedSystem != "" {
+		fmt.Fprint(out, "Checking the booted system configuration ... ")
+		booted, err := sshContext.GetBootedSystem(host)
+		if err != nil {
+			fmt.Fprintln(out, "Failed")
+			return err
+		}
+		if booted != options.ExpectedSystem {
+			fmt.Fprintln(out, "Failed")
+			return fmt.Errorf("%s booted into %s, but was expected to boot into %s", host.Name, booted, options.ExpectedSystem)
+		}
+		fmt.Fprintln(out, "OK")
+	}
+
+	return nil
+}
+
+// Polls condition every 2 seconds, until it's true or the deadline (unless zero) has passed.
+// Returns whether the condition became true.
+func waitUntil(out io.Writer, deadline time.Time, condition func() bool) bool {
+	for {
+		fmt.Fprint(out, ".")
+
+		if condition() {
+			return true
+		}
+		if !deadline.IsZero() && time.Now().Add(2*time.Second).After(deadline) {
+			return false
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
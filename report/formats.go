@@ -0,0 +1,105 @@
+package report
+
+import (
+	"encoding/xml"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     float64          `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     float64         `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func (r *Report) junitReport() junitTestSuites {
+	report := junitTestSuites{Name: "morph"}
+	for _, s := range r.suites {
+		junitSuite := junitTestSuite{
+			Name:     s.name,
+			Tests:    len(s.cases),
+			Failures: s.failures(),
+			Time:     s.duration(),
+		}
+		for _, c := range s.cases {
+			junitCase := junitTestCase{
+				Name:      c.name,
+				Classname: c.classname,
+				Time:      c.duration(),
+				SystemOut: c.output.String(),
+			}
+			if c.failed {
+				junitCase.Failure = &junitFailure{Message: c.failure, Text: c.failure}
+			}
+			junitSuite.Cases = append(junitSuite.Cases, junitCase)
+		}
+
+		report.Tests += junitSuite.Tests
+		report.Failures += junitSuite.Failures
+		report.Time += junitSuite.Time
+		report.Suites = append(report.Suites, junitSuite)
+	}
+	return report
+}
+
+type jsonSuite struct {
+	Name     string     `json:"name"`
+	Tests    int        `json:"tests"`
+	Failures int        `json:"failures"`
+	Duration float64    `json:"duration"`
+	Cases    []jsonCase `json:"cases"`
+}
+
+type jsonCase struct {
+	Name      string  `json:"name"`
+	Classname string  `json:"classname"`
+	Duration  float64 `json:"duration"`
+	Failure   string  `json:"failure,omitempty"`
+	Output    string  `json:"output,omitempty"`
+}
+
+func (r *Report) jsonReport() []jsonSuite {
+	report := make([]jsonSuite, 0)
+	for _, s := range r.suites {
+		suite := jsonSuite{
+			Name:     s.name,
+			Tests:    len(s.cases),
+			Failures: s.failures(),
+			Duration: s.duration(),
+			Cases:    make([]jsonCase, 0),
+		}
+		for _, c := range s.cases {
+			suite.Cases = append(suite.Cases, jsonCase{
+				Name:      c.name,
+				Classname: c.classname,
+				Duration:  c.duration(),
+				Failure:   c.failure,
+				Output:    c.output.String(),
+			})
+		}
+		report = append(report, suite)
+	}
+	return report
+}
@@ -0,0 +1,232 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DBCDK/morph/events"
+)
+
+// A report of a run, where each host is a test suite, and each phase, health check and secret of the host is a test
+// case. The report is built from the events emitted during the run (see Handle).
+type Report struct {
+	lock   sync.Mutex
+	suites []*suite
+	hosts  map[string]*suite
+}
+
+type suite struct {
+	name  string
+	cases []*testCase
+	// the phase the host is in, and its output so far
+	phase  *testCase
+	output bytes.Buffer
+	checks map[string]*testCase
+	// whether the host is done (or has failed)
+	done bool
+}
+
+type testCase struct {
+	name      string
+	classname string
+	start     time.Time
+	end       time.Time
+	failure   string
+	failed    bool
+	output    strings.Builder
+}
+
+func New() *Report {
+	return &Report{
+		hosts: make(map[string]*suite),
+	}
+}
+
+func (r *Report) suite(host string) *suite {
+	s, ok := r.hosts[host]
+	if !ok {
+		s = &suite{
+			name:   host,
+			checks: make(map[string]*testCase),
+		}
+		r.hosts[host] = s
+		r.suites = append(r.suites, s)
+	}
+	return s
+}
+
+// Add an event to the report
+func (r *Report) Handle(event events.Event) {
+	if event.Host == "" {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s := r.suite(event.Host)
+	switch event.Event {
+	case events.HostStart:
+		s.done = false
+	case events.Phase:
+		s.endPhase(event.Time, "")
+		s.phase = &testCase{name: event.Phase, classname: event.Host, start: event.Time}
+		s.cases = append(s.cases, s.phase)
+		// the same checks can run in several phases (e.g. after uploading secrets, and after activation)
+		s.checks = make(map[string]*testCase)
+	case events.HostDone:
+		s.endPhase(event.Time, "")
+		s.done = true
+	case events.HostFailed:
+		s.endPhase(event.Time, event.Error)
+		s.done = true
+	case events.HealthCheck:
+		// checks that timed out keep running in the background
+		if !s.done {
+			s.addCheckAttempt(event)
+		}
+	case events.SecretUpload:
+		c := &testCase{
+			name:      "secret " + event.Secret,
+			classname: event.Host + ".secrets",
+			start:     event.Time,
+			end:       event.Time,
+		}
+		fmt.Fprintf(&c.output, "%s: %s\n", event.Path, event.Status)
+		if event.Status == events.Failed {
+			c.failed = true
+			c.failure = event.Error
+		} else if event.Error != "" {
+			fmt.Fprintln(&c.output, event.Error)
+		}
+		s.cases = append(s.cases, c)
+	}
+}
+
+func (s *suite) endPhase(end time.Time, failure string) {
+	if s.phase == nil {
+		return
+	}
+
+	s.phase.end = end
+	s.phase.output.Write(s.output.Bytes())
+	if failure != "" {
+		s.phase.failed = true
+		s.phase.failure = failure
+	}
+
+	s.phase = nil
+	s.output.Reset()
+}
+
+// Each health check is a single test case, which fails if the check never succeeded
+func (s *suite) addCheckAttempt(event events.Event) {
+	key := event.Phase + "/" + event.Check
+	c, ok := s.checks[key]
+	if !ok {
+		c = &testCase{
+			name:      event.Check,
+			classname: event.Host + "." + strings.ReplaceAll(event.Phase, " ", "-"),
+			start:     event.Time.Add(-time.Duration(event.Duration * float64(time.Second))),
+		}
+		s.checks[key] = c
+		s.cases = append(s.cases, c)
+	} else if !c.failed {
+		// the check keeps running after it has succeeded, if other checks are still running; only the first success counts
+		return
+	}
+
+	c.end = event.Time
+	if event.Status == events.Failed {
+		c.failed = true
+		c.failure = fmt.Sprintf("%s did not succeed: %s", event.Check, event.Error)
+		fmt.Fprintf(&c.output, "Failed (%s)\n", event.Error)
+	} else {
+		c.failed = false
+		c.failure = ""
+		fmt.Fprintln(&c.output, "OK")
+	}
+}
+
+// Returns a writer capturing the output of a host, which ends up in the test case of the phase the host is in
+func (r *Report) Output(host string) io.Writer {
+	return &outputWriter{report: r, host: host}
+}
+
+type outputWriter struct {
+	report *Report
+	host   string
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.report.lock.Lock()
+	defer w.report.lock.Unlock()
+
+	return w.report.suite(w.host).output.Write(p)
+}
+
+// Write the report to a file; as JSON if the file name ends with .json, and as JUnit XML otherwise
+func (r *Report) WriteFile(path string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, s := range r.suites {
+		s.endPhase(time.Now().UTC(), "morph exited before the phase was done")
+	}
+
+	var data []byte
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		data, err = json.MarshalIndent(r.jsonReport(), "", "  ")
+	} else {
+		data, err = xml.MarshalIndent(r.junitReport(), "", "  ")
+		data = append([]byte(xml.Header), data...)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func (c *testCase) duration() float64 {
+	if c.end.IsZero() {
+		return 0
+	}
+	return c.end.Sub(c.start).Seconds()
+}
+
+func (s *suite) failures() (failures int) {
+	for _, c := range s.cases {
+		if c.failed {
+			failures++
+		}
+	}
+	return
+}
+
+func (s *suite) duration() float64 {
+	if len(s.cases) == 0 {
+		return 0
+	}
+
+	start := s.cases[0].start
+	end := start
+	for _, c := range s.cases {
+		if c.start.Before(start) {
+			start = c.start
+		}
+		if c.end.After(end) {
+			end = c.end
+		}
+	}
+	return end.Sub(start).Seconds()
+}
@@ -0,0 +1,117 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directory on the target hosts, holding a record of each activation done by morph
+const HistoryDir = StateDir + "/history"
+
+// How many activations are kept on each host; older records are removed when an activation is recorded
+const HistoryLimit = 200
+
+type HistoryRecord struct {
+	Time        time.Time `json:"time"`
+	System      string    `json:"system"`
+	Action      string    `json:"action"`
+	Command     string    `json:"command"`
+	Deployer    string    `json:"deployer"`
+	Deployment  string    `json:"deployment"`
+	GitRevision string    `json:"gitRevision,omitempty"`
+}
+
+// Record an activation on the host. Each record is kept in its own file, named after the time of the activation.
+func (ctx *SSHContext) AddHistoryRecord(host Host, record HistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+
+	name := record.Time.UTC().Format("20060102T150405.000000000Z") + ".json"
+	if err = ctx.writeStateFile(host, filepath.Join(HistoryDir, name), data, "0644"); err != nil {
+		return err
+	}
+
+	return ctx.pruneHistory(host)
+}
+
+// Remove the oldest records, beyond HistoryLimit
+func (ctx *SSHContext) pruneHistory(host Host) error {
+	listing, err := ctx.output(host, "ls", "-1", HistoryDir)
+	if err != nil {
+		return err
+	}
+
+	// the records are named after the time of the activation, so they sort chronologically
+	names := make([]string, 0)
+	for _, name := range strings.Fields(listing) {
+		if strings.HasSuffix(name, ".json") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) <= HistoryLimit {
+		return nil
+	}
+
+	// in batches, since there can be many records the first time a long history is pruned
+	old := names[:len(names)-HistoryLimit]
+	for len(old) > 0 {
+		batch := old[:min(len(old), 100)]
+		old = old[len(batch):]
+
+		parts := []string{"rm", "-f"}
+		for _, name := range batch {
+			parts = append(parts, filepath.Join(HistoryDir, name))
+		}
+		cmd, err := ctx.SudoCmd(host, parts...)
+		if err != nil {
+			return err
+		}
+
+		data, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Couldn't remove old history records on %s:\n\t%s", host.GetName(), string(data))
+		}
+	}
+
+	return nil
+}
+
+// Returns the activations recorded on the host, oldest first
+func (ctx *SSHContext) GetHistory(host Host) (records []HistoryRecord, err error) {
+	exists, err := ctx.dirExists(host, HistoryDir)
+	if err != nil || !exists {
+		return records, err
+	}
+
+	// each record is a single line of JSON. find passes the records to cat in batches, since there can be more of them
+	// than fit on a single command line.
+	data, err := ctx.output(host, "find", HistoryDir, "-name", "'*.json'", "-exec", "cat", "{}", "+")
+	if err != nil {
+		return records, err
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		record := HistoryRecord{}
+		if err = json.Unmarshal([]byte(line), &record); err != nil {
+			return records, fmt.Errorf("Couldn't parse history record on %s: %s", host.GetName(), err)
+		}
+		records = append(records, record)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	return records, nil
+}
@@ -0,0 +1,149 @@
+package ssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+// Directory on the target hosts, whose existence means a deployment is in progress.
+// Creating a directory is atomic, so only one morph can take the lock.
+const LockDir = StateDir + "/lock"
+const lockInfo = LockDir + "/info"
+
+// Describes who holds the (advisory) deployment lock of a host
+type Lock struct {
+	Holder     string    `json:"holder"`
+	Time       time.Time `json:"time"`
+	Deployment string    `json:"deployment"`
+}
+
+func NewLock(deployment string) Lock {
+	return Lock{
+		Holder:     Deployer(),
+		Time:       time.Now().UTC().Truncate(time.Second),
+		Deployment: deployment,
+	}
+}
+
+// The local user running morph, as user@hostname
+func Deployer() string {
+	deployer := "unknown"
+	if currentUser, err := user.Current(); err == nil {
+		deployer = currentUser.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		deployer += "@" + hostname
+	}
+	return deployer
+}
+
+func (lock Lock) String() string {
+	if lock.Holder == "" {
+		return "an unknown holder (the lock is being taken)"
+	}
+	return fmt.Sprintf("%s since %s (deployment: %s)", lock.Holder, lock.Time.Local().Format(time.RFC1123), lock.Deployment)
+}
+
+func (lock Lock) equals(other Lock) bool {
+	return lock.Holder == other.Holder && lock.Time.Equal(other.Time) && lock.Deployment == other.Deployment
+}
+
+type LockedError struct {
+	Host string
+	Lock Lock
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s", e.Host, e.Lock)
+}
+
+// Take the deployment lock of a host. Returns a *LockedError if somebody else holds the lock.
+func (ctx *SSHContext) AcquireLock(host Host, lock Lock) error {
+	if err := ctx.MakeDirs(host, StateDir, true, 0755); err != nil {
+		return err
+	}
+
+	cmd, err := ctx.SudoCmd(host, "mkdir", LockDir)
+	if err != nil {
+		return err
+	}
+
+	data, err := cmd.CombinedOutput()
+	if err != nil {
+		held, getErr := ctx.GetLock(host)
+		if getErr == nil && held != nil {
+			return &LockedError{Host: host.GetName(), Lock: *held}
+		}
+		errorMessage := fmt.Sprintf(
+			"\tCouldn't take the deployment lock on remote host:\n\t%s", string(data),
+		)
+		return errors.New(errorMessage)
+	}
+
+	data, err = json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	if err = ctx.writeStateFile(host, lockInfo, data, "0644"); err != nil {
+		_ = ctx.RemoveLock(host)
+		return err
+	}
+
+	return nil
+}
+
+// Release a lock taken by AcquireLock. The lock is left alone, if it has been taken over (using RemoveLock) since.
+func (ctx *SSHContext) ReleaseLock(host Host, lock Lock) error {
+	held, err := ctx.GetLock(host)
+	if err != nil {
+		return err
+	}
+	if held == nil || !held.equals(lock) {
+		return nil
+	}
+
+	return ctx.RemoveLock(host)
+}
+
+// Remove the deployment lock of a host, regardless of who holds it
+func (ctx *SSHContext) RemoveLock(host Host) error {
+	cmd, err := ctx.SudoCmd(host, "rm", "-rf", LockDir)
+	if err != nil {
+		return err
+	}
+
+	data, err := cmd.CombinedOutput()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"\tCouldn't remove the deployment lock on remote host:\n\t%s", string(data),
+		)
+		return errors.New(errorMessage)
+	}
+
+	return nil
+}
+
+// Returns the deployment lock held on a host, or nil if the host isn't locked
+func (ctx *SSHContext) GetLock(host Host) (*Lock, error) {
+	locked, err := ctx.dirExists(host, LockDir)
+	if err != nil || !locked {
+		return nil, err
+	}
+
+	lock := Lock{}
+	data, err := ctx.output(host, "cat", lockInfo)
+	if err != nil {
+		// the lock is being taken, and the holder hasn't been written yet
+		return &lock, nil
+	}
+
+	if err = json.Unmarshal([]byte(data), &lock); err != nil {
+		return nil, err
+	}
+
+	return &lock, nil
+}
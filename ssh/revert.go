@@ -0,0 +1,229 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Script reverting an unconfirmed activation. It's started by ActivationScript once the activation is done, and
+// re-started at boot by the morph-revert-on-boot service (deployment.revertOnBoot, see data/options.nix).
+const RevertScript = StateDir + "/revert.sh"
+
+// Script activating the new configuration and then starting the revert timer, both in the transient unit RevertUnit.
+// Since the unit doesn't depend on the SSH connection, losing the connection during the activation (e.g. since it
+// broke sshd) can't leave the timer unarmed. It's also used to follow the activation: see ActivateWithRevert.
+const ActivationScript = StateDir + "/activate.sh"
+const activationLog = StateDir + "/activation.log"
+const activationStatus = StateDir + "/activation.status"
+
+const RevertUnit = "morph-revert"
+
+type Revert struct {
+	// The configuration and system profile generation to return to
+	Configuration string
+	Generation    int
+	// The switch-action that was used to activate the new configuration
+	Action string
+	// Seconds to wait for confirmation before reverting
+	Timeout int
+}
+
+func (revert Revert) script() string {
+	var script strings.Builder
+
+	fmt.Fprintln(&script, "#!/bin/sh")
+	fmt.Fprintln(&script, "# Written by morph: reverts to the previous configuration, unless the activation is confirmed in time")
+	fmt.Fprintf(&script, "export PATH=%s:$PATH\n", filepath.Join(revert.Configuration, "sw/bin"))
+	fmt.Fprintf(&script, "sleep %d\n", revert.Timeout)
+	// morph confirms by removing this script
+	fmt.Fprintf(&script, "[ -e %s ] || exit 0\n", RevertScript)
+	fmt.Fprintf(&script, "rm -f %s\n", RevertScript)
+	fmt.Fprintln(&script, "echo 'Activation was not confirmed, reverting to the previous configuration'")
+
+	fmt.Fprintf(&script, "action=%s\n", revert.Action)
+	// after a reboot the new configuration is running, even though it was only made the default for the next boot
+	fmt.Fprintln(&script, `[ "$1" = after-boot ] && [ "$action" = boot ] && action=switch`)
+	if revert.Action == "switch" || revert.Action == "boot" {
+		fmt.Fprintf(&script, "nix-env --profile %s --switch-generation %d\n", SystemProfile, revert.Generation)
+	}
+	fmt.Fprintf(&script, "exec %s \"$action\"\n", filepath.Join(revert.Configuration, "bin/switch-to-configuration"))
+
+	return script.String()
+}
+
+func activationScript(configuration string, action string) string {
+	var script strings.Builder
+
+	fmt.Fprintln(&script, "#!/bin/sh")
+	fmt.Fprintln(&script, "# Written by morph: activates a configuration, and starts reverting it unless it's confirmed in time")
+	// morph follows the activation with the follow argument, until its exit status is written
+	fmt.Fprintln(&script, `if [ "$1" = follow ]; then`)
+	fmt.Fprintf(&script, "  while [ ! -e %s ]; do sleep 1; done\n", activationLog)
+	fmt.Fprintf(&script, "  tail -n +1 -f %s &\n", activationLog)
+	fmt.Fprintln(&script, "  tail=$!")
+	fmt.Fprintf(&script, "  while [ ! -e %s ]; do sleep 1; done\n", activationStatus)
+	fmt.Fprintln(&script, "  sleep 1")
+	fmt.Fprintln(&script, `  kill "$tail"`)
+	fmt.Fprintf(&script, "  exit \"$(cat %s)\"\n", activationStatus)
+	fmt.Fprintln(&script, "fi")
+
+	fmt.Fprintln(&script, "export PATH=/run/current-system/sw/bin:$PATH")
+	fmt.Fprintf(&script, "exec >%s 2>&1\n", activationLog)
+	fmt.Fprintln(&script, "(")
+	if action == "switch" || action == "boot" {
+		fmt.Fprintf(&script, "  nix-env --profile %s --set %s &&\n", SystemProfile, configuration)
+	}
+	fmt.Fprintf(&script, "  %s %s\n", filepath.Join(configuration, "bin/switch-to-configuration"), action)
+	fmt.Fprintln(&script, ")")
+	fmt.Fprintf(&script, "echo $? >%s\n", activationStatus)
+	// a failed activation is reverted as well
+	fmt.Fprintf(&script, "exec /bin/sh %s\n", RevertScript)
+
+	return script.String()
+}
+
+// Activate a configuration, and start a timer on the host which reverts to the previous configuration unless
+// ConfirmActivation is called in time. The activation and the timer run in the same transient unit on the host, so
+// the timer is started even if the activation breaks the SSH connection. The timer starts once the activation is
+// done, so a slow activation isn't reverted halfway through.
+func (ctx *SSHContext) ActivateWithRevert(host Host, configuration string, action string, revert Revert) error {
+	err := ctx.writeStateFile(host, RevertScript, []byte(revert.script()), "0700")
+	if err != nil {
+		return err
+	}
+	err = ctx.writeStateFile(host, ActivationScript, []byte(activationScript(configuration, action)), "0700")
+	if err != nil {
+		return err
+	}
+
+	// a left-over timer from an earlier deployment would prevent starting a new one
+	if cmd, err := ctx.SudoCmd(host, "systemctl", "stop", RevertUnit+".service"); err == nil {
+		_ = cmd.Run()
+	}
+	if cmd, err := ctx.SudoCmd(host, "rm", "-f", activationLog, activationStatus); err == nil {
+		_ = cmd.Run()
+	}
+
+	cmd, err := ctx.SudoCmd(host, "/run/current-system/sw/bin/systemd-run", "--unit="+RevertUnit, "--collect", "/bin/sh", ActivationScript)
+	if err != nil {
+		return err
+	}
+
+	data, err := cmd.CombinedOutput()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"\tCouldn't start activation and revert timer on remote host:\n\t%s", string(data),
+		)
+		return errors.New(errorMessage)
+	}
+
+	cmd, err = ctx.SudoCmd(host, "/bin/sh", ActivationScript, "follow")
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdout = ctx.Stderr()
+	cmd.Stderr = ctx.Stderr()
+	err = cmd.Run()
+	if isConnectionFailure(err) {
+		return errors.New("Lost the connection while activating new configuration.")
+	}
+	if err != nil {
+		return errors.New("Error while activating new configuration.")
+	}
+
+	return nil
+}
+
+// Confirm an activation over a new SSH connection, stopping the revert timer started by ArmRevert.
+// Connection errors are retried until the deadline.
+func (ctx *SSHContext) ConfirmActivation(host Host, deadline time.Time) error {
+	freshCtx := *ctx
+	freshCtx.NoMultiplexing = true
+	out := ctx.Stderr()
+
+	fmt.Fprint(out, "Confirming activation over a new connection ")
+	for {
+		fmt.Fprint(out, ".")
+
+		retry, err := freshCtx.removeRevertScript(host)
+		if err == nil {
+			break
+		}
+
+		if errors.Is(err, errRevertStarted) {
+			fmt.Fprintln(out, " Failed")
+			return errors.New("Activation could not be confirmed, since the host has already begun reverting to the previous configuration.")
+		}
+		if !retry {
+			fmt.Fprintln(out, " Failed")
+			return fmt.Errorf("Activation could not be confirmed: %s. The host will revert to the previous configuration.", err)
+		}
+		if time.Now().After(deadline) {
+			fmt.Fprintln(out, " Failed")
+			return errors.New("Activation could not be confirmed in time. The host will revert to the previous configuration.")
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+	fmt.Fprintln(out, " OK")
+
+	if cmd, err := freshCtx.SudoCmd(host, "systemctl", "stop", RevertUnit+".service"); err == nil {
+		_ = cmd.Run()
+	}
+
+	return nil
+}
+
+// Returned by removeRevertScript when the script is gone, since the host has begun reverting
+var errRevertStarted = errors.New("the revert script is gone")
+
+// Returns whether a failure was caused by the connection (and should be retried)
+func (ctx *SSHContext) removeRevertScript(host Host) (retry bool, err error) {
+	timeoutCtx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	cmd, err := ctx.SudoCmdContext(timeoutCtx, host, "rm", RevertScript)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := cmd.CombinedOutput()
+	if err == nil {
+		return false, nil
+	}
+	if timeoutCtx.Err() != nil || isConnectionFailure(err) {
+		return true, err
+	}
+
+	// rm also fails for other reasons than the script being gone, e.g. if sudo fails
+	cmd, testErr := ctx.CmdContext(timeoutCtx, host, "test", "-e", RevertScript)
+	if testErr != nil {
+		return false, testErr
+	}
+	testErr = cmd.Run()
+	if timeoutCtx.Err() != nil || isConnectionFailure(testErr) {
+		return true, err
+	}
+	if exitErr, ok := testErr.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, errRevertStarted
+	}
+
+	return false, fmt.Errorf("Couldn't remove %s: %s", RevertScript, strings.TrimSpace(string(data)))
+}
+
+// Returns whether the error of running a command over SSH means the connection failed (exit code 255)
+func isConnectionFailure(err error) bool {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 255 {
+			return true
+		}
+	}
+	return false
+}
@@ -11,6 +11,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -29,6 +31,8 @@ type Context interface {
 	Cmd(host Host, parts ...string) (*exec.Cmd, error)
 	SudoCmd(host Host, parts ...string) (*exec.Cmd, error)
 	CmdInteractive(host Host, timeout int, parts ...string)
+
+	Stderr() io.Writer
 }
 
 type Host interface {
@@ -46,6 +50,8 @@ type SSHContext struct {
 	IdentityFile           string
 	ConfigFile             string
 	SkipHostKeyCheck       bool
+	NoMultiplexing         bool
+	Output                 io.Writer
 }
 
 type FileTransfer struct {
@@ -53,6 +59,21 @@ type FileTransfer struct {
 	Destination string
 }
 
+// Returns the writer command output and progress should be written to (stderr unless overridden)
+func (sshCtx *SSHContext) Stderr() io.Writer {
+	if sshCtx.Output != nil {
+		return sshCtx.Output
+	}
+	return os.Stderr
+}
+
+// Returns a copy of the context, which writes command output and progress to out
+func (sshCtx *SSHContext) WithOutput(out io.Writer) *SSHContext {
+	hostCtx := *sshCtx
+	hostCtx.Output = out
+	return &hostCtx
+}
+
 func (sshCtx *SSHContext) Cmd(host Host, parts ...string) (*exec.Cmd, error) {
 	return sshCtx.CmdContext(context.TODO(), host, parts...)
 }
@@ -95,6 +116,12 @@ func (ctx *SSHContext) sshArgs(host Host, transfer *FileTransfer) (cmd string, a
 	if ctx.ConfigFile != "" {
 		args = append(args, "-F", ctx.ConfigFile)
 	}
+	if ctx.NoMultiplexing {
+		// never reuse an existing (control master) connection
+		args = append(args,
+			"-o", "ControlMaster=no",
+			"-o", "ControlPath=none")
+	}
 	var hostAndDestination = host.GetTargetHost()
 	if host.GetTargetPort() != 0 {
 		var optionName string
@@ -131,27 +158,8 @@ func (sshCtx *SSHContext) SudoCmdContext(ctx context.Context, host Host, parts .
 		return nil, err
 	}
 
-	// ask for password if not done already
-	if sshCtx.AskForSudoPassword && sshCtx.sudoPassword == "" {
-		sshCtx.sudoPassword, err = askForSudoPassword()
-		if err != nil {
-			return nil, err
-		}
-	} else if sshCtx.GetSudoPasswordCommand != "" {
-		command := strings.Fields(sshCtx.GetSudoPasswordCommand)
-		var argsArr = []string{}
-		for i, e := range command {
-			if i != 0 {
-				argsArr = append(argsArr, e)
-			}
-		}
-		passCmd := exec.Command(command[0], argsArr...)
-
-		passOut, err := passCmd.Output()
-		if err != nil {
-			panic(err)
-		}
-		sshCtx.sudoPassword = string(passOut)
+	if err = sshCtx.PrepareSudoPassword(); err != nil {
+		return nil, err
 	}
 
 	cmd, cmdArgs := sshCtx.sshArgs(host, nil)
@@ -182,6 +190,34 @@ func (sshCtx *SSHContext) SudoCmdContext(ctx context.Context, host Host, parts .
 	return command, nil
 }
 
+// Ask for (or run the command supplying) the remote sudo password, if not done already.
+// This has to happen before the context is copied for concurrent use, since the password isn't shared between copies.
+func (sshCtx *SSHContext) PrepareSudoPassword() (err error) {
+	if sshCtx.AskForSudoPassword && sshCtx.sudoPassword == "" {
+		sshCtx.sudoPassword, err = askForSudoPassword()
+		if err != nil {
+			return err
+		}
+	} else if sshCtx.GetSudoPasswordCommand != "" {
+		command := strings.Fields(sshCtx.GetSudoPasswordCommand)
+		var argsArr = []string{}
+		for i, e := range command {
+			if i != 0 {
+				argsArr = append(argsArr, e)
+			}
+		}
+		passCmd := exec.Command(command[0], argsArr...)
+
+		passOut, err := passCmd.Output()
+		if err != nil {
+			panic(err)
+		}
+		sshCtx.sudoPassword = string(passOut)
+	}
+
+	return nil
+}
+
 func valCommand(parts []string) ([]string, error) {
 
 	if len(parts) < 1 {
@@ -197,19 +233,19 @@ func (sshCtx *SSHContext) CmdInteractive(host Host, timeout int, parts ...string
 
 	cmd, err := sshCtx.CmdContext(ctx, host, parts...)
 	if err == nil {
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = sshCtx.Stderr()
+		cmd.Stderr = sshCtx.Stderr()
 		err = cmd.Run()
 	}
 
 	// context was cancelled
 	if ctx.Err() != nil {
-		fmt.Fprintf(os.Stderr, "Exec of cmd: %s timed out\n", parts)
+		fmt.Fprintf(sshCtx.Stderr(), "Exec of cmd: %s timed out\n", parts)
 		return
 	}
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Exec of cmd: %s failed with err: '%s'\n", parts, err.Error())
+		fmt.Fprintf(sshCtx.Stderr(), "Exec of cmd: %s failed with err: '%s'\n", parts, err.Error())
 	}
 }
 
@@ -242,22 +278,58 @@ func writeSudoPassword(cmd *exec.Cmd, sudoPasswd string) (err error) {
 	return nil
 }
 
+const SystemProfile = "/nix/var/nix/profiles/system"
+
 func (ctx *SSHContext) ActivateConfiguration(host Host, configuration string, action string) error {
 
 	if action == "switch" || action == "boot" {
-		cmd, err := ctx.SudoCmd(host, "nix-env", "--profile", "/nix/var/nix/profiles/system", "--set", configuration)
+		err := ctx.SetSystemProfile(host, configuration)
 		if err != nil {
 			return err
 		}
+	}
 
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+	return ctx.SwitchToConfiguration(host, configuration, action)
+}
+
+// Add configuration as a new generation of the system profile
+func (ctx *SSHContext) SetSystemProfile(host Host, configuration string) error {
+	cmd, err := ctx.SudoCmd(host, "nix-env", "--profile", SystemProfile, "--set", configuration)
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdout = ctx.Stderr()
+	cmd.Stderr = ctx.Stderr()
+	return cmd.Run()
+}
+
+// Point the system profile at an existing generation, without creating a new one
+func (ctx *SSHContext) SwitchGeneration(host Host, generation int) error {
+	cmd, err := ctx.SudoCmd(host, "nix-env", "--profile", SystemProfile, "--switch-generation", strconv.Itoa(generation))
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdout = ctx.Stderr()
+	cmd.Stderr = ctx.Stderr()
+	return cmd.Run()
+}
+
+// Activate an existing generation of the system profile. For switch and boot, the system profile is pointed at the
+// generation instead of adding its configuration as a new generation.
+func (ctx *SSHContext) ActivateGeneration(host Host, configuration string, generation int, action string) error {
+	if action == "switch" || action == "boot" {
+		err := ctx.SwitchGeneration(host, generation)
 		if err != nil {
 			return err
 		}
 	}
 
+	return ctx.SwitchToConfiguration(host, configuration, action)
+}
+
+func (ctx *SSHContext) SwitchToConfiguration(host Host, configuration string, action string) error {
 	args := []string{filepath.Join(configuration, "bin/switch-to-configuration"), action}
 
 	var (
@@ -269,8 +341,8 @@ func (ctx *SSHContext) ActivateConfiguration(host Host, configuration string, ac
 		return err
 	}
 
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = ctx.Stderr()
+	cmd.Stderr = ctx.Stderr()
 	err = cmd.Run()
 	if err != nil {
 		return errors.New("Error while activating new configuration.")
@@ -279,6 +351,273 @@ func (ctx *SSHContext) ActivateConfiguration(host Host, configuration string, ac
 	return nil
 }
 
+// Returns the store path of the running system configuration
+func (ctx *SSHContext) GetCurrentSystem(host Host) (string, error) {
+	return ctx.output(host, "readlink", "-f", "/run/current-system")
+}
+
+// Returns the store path of the system configuration the host was booted into
+func (ctx *SSHContext) GetBootedSystem(host Host) (string, error) {
+	return ctx.output(host, "readlink", "-f", "/run/booted-system")
+}
+
+// Returns whether activating configuration fully requires a reboot, i.e. whether its kernel, initrd or kernel
+// parameters differ from those of the booted system
+func (ctx *SSHContext) NeedsReboot(host Host, configuration string) (bool, error) {
+	reasons, err := ctx.RebootReasons(host, configuration)
+	return len(reasons) > 0, err
+}
+
+// Returns which of the kernel, initrd and kernel parameters of configuration differ from those of the booted system
+func (ctx *SSHContext) RebootReasons(host Host, configuration string) (reasons []string, err error) {
+	for _, system := range []string{"/run/booted-system", configuration} {
+		hasKernel, err := ctx.exists(host, filepath.Join(system, "kernel"))
+		if err != nil {
+			return nil, err
+		}
+		if !hasKernel {
+			// containers have neither kernel nor initrd
+			return nil, nil
+		}
+	}
+
+	booted, err := ctx.bootFiles(host, "/run/booted-system")
+	if err != nil {
+		return nil, err
+	}
+
+	activated, err := ctx.bootFiles(host, configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	for index, name := range []string{"kernel", "initrd", "kernel-params"} {
+		if booted[index] != activated[index] {
+			reasons = append(reasons, name)
+		}
+	}
+	return reasons, nil
+}
+
+// Returns whether path exists on the host. Failing to check, e.g. since the host can't be reached, is an error.
+func (ctx *SSHContext) exists(host Host, path string) (bool, error) {
+	cmd, err := ctx.Cmd(host, "test", "-e", path)
+	if err != nil {
+		return false, err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("Error on remote host %s (%s):\nCouldn't check whether %s exists: %s\n%s",
+		host.GetName(), host.GetTargetHost(), path, err, strings.TrimSpace(stderr.String()))
+}
+
+// Returns the resolved kernel and initrd paths and the kernel parameters of a system configuration
+func (ctx *SSHContext) bootFiles(host Host, configuration string) ([3]string, error) {
+	var files [3]string
+
+	paths, err := ctx.output(host, "readlink", "-f", filepath.Join(configuration, "kernel"), filepath.Join(configuration, "initrd"))
+	if err != nil {
+		return files, err
+	}
+	copy(files[:], strings.SplitN(paths, "\n", 2))
+
+	files[2], err = ctx.output(host, "cat", filepath.Join(configuration, "kernel-params"))
+	if err != nil {
+		return files, err
+	}
+
+	return files, nil
+}
+
+// Returns the generation number the system profile currently points to
+func (ctx *SSHContext) GetSystemGeneration(host Host) (int, error) {
+	link, err := ctx.output(host, "readlink", SystemProfile)
+	if err != nil {
+		return 0, err
+	}
+
+	// the profile is a symlink to "system-<generation>-link"
+	generation, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(link), "system-"), "-link"))
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't determine system generation from profile link: %s", link)
+	}
+
+	return generation, nil
+}
+
+// Returns all generations of the system profile in ascending order, and the current generation
+func (ctx *SSHContext) GetSystemGenerations(host Host) (generations []int, current int, err error) {
+	output, err := ctx.output(host, "nix-env", "--profile", SystemProfile, "--list-generations")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// each line looks like: "  42   2024-01-31 12:00:00   (current)"
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		generation, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, 0, fmt.Errorf("Unexpected output from nix-env --list-generations: %s", line)
+		}
+		generations = append(generations, generation)
+
+		if fields[len(fields)-1] == "(current)" {
+			current = generation
+		}
+	}
+
+	sort.Ints(generations)
+
+	return generations, current, nil
+}
+
+// Returns the store path of the configuration of the given system profile generation
+func (ctx *SSHContext) GetGenerationPath(host Host, generation int) (string, error) {
+	return ctx.output(host, "readlink", "-f", fmt.Sprintf("%s-%d-link", SystemProfile, generation))
+}
+
+// Returns the store paths in the closure of path
+func (ctx *SSHContext) GetClosure(host Host, path string) ([]string, error) {
+	output, err := ctx.output(host, "nix-store", "--query", "--requisites", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(output), nil
+}
+
+// Build (or substitute) the outputs of a derivation on the host, showing the build output
+func (ctx *SSHContext) Realise(host Host, derivations []string, options ...string) error {
+	// the outputs get GC roots until morph exits, so they can't be garbage-collected before they're used
+	rootDir, err := ctx.makeGCRootDir(host)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"nix-store", "--realise", "--add-root", rootDir + "/result", "--indirect"}, derivations...)
+	cmd, err := ctx.Cmd(host, append(args, options...)...)
+	if err != nil {
+		return err
+	}
+
+	// the output paths printed on stdout are known already
+	cmd.Stdout = io.Discard
+	cmd.Stderr = ctx.Stderr()
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Error while building %s on %s: %s", strings.Join(derivations, ", "), host.GetName(), err)
+	}
+
+	return nil
+}
+
+// Copies the closures of the paths from one host to another, by running nix-copy-closure on the first host.
+// The first host has to be able to log in to the other host on its own, since the SSH settings of morph are local.
+func (ctx *SSHContext) CopyClosure(from Host, to Host, paths []string, useSubstitutes bool) error {
+	destination := to.GetTargetHost()
+	if to.GetTargetUser() != "" {
+		destination = to.GetTargetUser() + "@" + destination
+	} else if ctx.DefaultUsername != "" {
+		destination = ctx.DefaultUsername + "@" + destination
+	}
+
+	parts := make([]string, 0)
+	if to.GetTargetPort() != 0 {
+		parts = append(parts, "env", fmt.Sprintf("NIX_SSHOPTS=-p%d", to.GetTargetPort()))
+	}
+	parts = append(parts, "nix-copy-closure", "--to", destination)
+	if useSubstitutes {
+		parts = append(parts, "--use-substitutes")
+	}
+	parts = append(parts, paths...)
+
+	cmd, err := ctx.Cmd(from, parts...)
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdout = ctx.Stderr()
+	cmd.Stderr = ctx.Stderr()
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Error while copying paths from %s to %s: %s", from.GetName(), to.GetName(), err)
+	}
+
+	return nil
+}
+
+// Returns the NAR size of each of the store paths. The paths are passed to nix-store by xargs, since there can be too
+// many of them for a single command line.
+func (ctx *SSHContext) GetPathSizes(host Host, paths []string) ([]int64, error) {
+	output, err := ctx.outputWithInput(host, strings.Join(paths, "\n"), "xargs", "nix-store", "--query", "--size")
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSizes(output, len(paths))
+}
+
+// Parse the output of `nix-store --query --size`
+func ParseSizes(output string, expected int) ([]int64, error) {
+	sizes := make([]int64, 0)
+	for _, field := range strings.Fields(output) {
+		size, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+
+	if len(sizes) != expected {
+		return nil, errors.New(fmt.Sprintf("Expected %d sizes from nix-store, got %d", expected, len(sizes)))
+	}
+
+	return sizes, nil
+}
+
+// Run a command on the host, and return its trimmed stdout
+func (ctx *SSHContext) output(host Host, parts ...string) (string, error) {
+	return ctx.outputWithInput(host, "", parts...)
+}
+
+// Like output, but with input on the standard input of the command
+func (ctx *SSHContext) outputWithInput(host Host, input string, parts ...string) (string, error) {
+	cmd, err := ctx.Cmd(host, parts...)
+	if err != nil {
+		return "", err
+	}
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error on remote host %s (%s):\nCommand `%s` failed\n\nOriginal error:\n%s",
+			host.GetName(), host.GetTargetHost(), strings.Join(parts, " "), stderr.String(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
 func (sshCtx *SSHContext) GetBootID(host Host) (string, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
 	defer cancel()
@@ -289,7 +628,7 @@ func (sshCtx *SSHContext) GetBootID(host Host) (string, error) {
 
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = sshCtx.Stderr()
 
 	err = cmd.Run()
 	if err != nil {
@@ -299,6 +638,71 @@ func (sshCtx *SSHContext) GetBootID(host Host) (string, error) {
 	return strings.TrimSpace(stdout.String()), nil
 }
 
+// Returns whether a command can be run on the host within 5 seconds
+func (sshCtx *SSHContext) IsReachable(host Host) bool {
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	cmd, err := sshCtx.CmdContext(ctx, host, "true")
+	if err != nil {
+		return false
+	}
+
+	return cmd.Run() == nil
+}
+
+// Returns how long the host has been up, according to /proc/uptime
+func (sshCtx *SSHContext) GetUptime(host Host) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	cmd, err := sshCtx.CmdContext(ctx, host, "cat", "/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Couldn't parse /proc/uptime of %s: %q", host.GetName(), output)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't parse /proc/uptime of %s: %s", host.GetName(), err)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Returns whether a systemd unit (e.g. multi-user.target) is active on the host
+func (sshCtx *SSHContext) IsUnitActive(host Host, unit string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	cmd, err := sshCtx.CmdContext(ctx, host, "systemctl", "is-active", "--quiet", unit)
+	if err != nil {
+		return false, err
+	}
+
+	return cmd.Run() == nil, nil
+}
+
+// Makes a temporary directory on the host for GC roots, which is removed again when morph exits
+func (ctx *SSHContext) makeGCRootDir(host Host) (string, error) {
+	path, err := ctx.output(host, "mktemp", "-d", "-t", "morph-gcroots.XXXXXXXX")
+	if err != nil {
+		return "", err
+	}
+
+	utils.AddFinalizer(func() {
+		if cmd, err := ctx.Cmd(host, "rm", "-rf", path); err == nil {
+			cmd.Run()
+		}
+	})
+	return path, nil
+}
+
 func (ctx *SSHContext) MakeTempFile(host Host) (path string, err error) {
 	cmd, _ := ctx.Cmd(host, "mktemp")
 
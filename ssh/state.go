@@ -0,0 +1,67 @@
+package ssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// Directory on the target hosts, where morph keeps its state
+const StateDir = "/var/lib/morph"
+
+// Write a file owned by root on the host, creating its parent directory (below StateDir) if needed
+func (ctx *SSHContext) writeStateFile(host Host, destination string, contents []byte, permissions string) error {
+	localFile, err := ioutil.TempFile("", "morph-state-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localFile.Name())
+
+	_, err = localFile.Write(contents)
+	localFile.Close()
+	if err != nil {
+		return err
+	}
+
+	tempPath, err := ctx.MakeTempFile(host)
+	if err != nil {
+		return err
+	}
+	if err = ctx.UploadFile(host, localFile.Name(), tempPath); err != nil {
+		return err
+	}
+	if err = ctx.MakeDirs(host, filepath.Dir(destination), true, 0755); err != nil {
+		return err
+	}
+	if err = ctx.MoveFile(host, tempPath, destination); err != nil {
+		return err
+	}
+	if err = ctx.SetOwner(host, destination, "root", "root"); err != nil {
+		return err
+	}
+	return ctx.SetPermissions(host, destination, permissions)
+}
+
+// Returns whether a directory exists on the host
+func (ctx *SSHContext) dirExists(host Host, path string) (bool, error) {
+	cmd, err := ctx.Cmd(host, "test", "-d", path)
+	if err != nil {
+		return false, err
+	}
+
+	err = cmd.Run()
+	if err != nil {
+		// exit code 1 means the directory doesn't exist, 255 means the connection failed
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 1 {
+				return false, nil
+			}
+		}
+		return false, fmt.Errorf("Couldn't check for %s on %s: %s", path, host.GetName(), err)
+	}
+
+	return true, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
@@ -13,7 +14,10 @@ type finalizer struct {
 }
 type FinalizerFunc func()
 
-var finalizers []*finalizer
+var (
+	finalizers     []*finalizer
+	finalizersLock sync.Mutex
+)
 
 /*
 Finalizers run sequentially at morph shutdown - both at clean shutdown and on errors.
@@ -21,19 +25,36 @@ Finalizers should be quick, simple and they need to ignore errors and don't pani
 Each finalizer will only run once and will _never_ be re-invoked.
 */
 func (f *finalizer) Run() {
-	if !f.executed {
-		f.executed = true
+	finalizersLock.Lock()
+	executed := f.executed
+	f.executed = true
+	finalizersLock.Unlock()
+
+	if !executed {
 		f.function()
 	}
 }
 
+// The finalizers run without holding finalizersLock, so they may add finalizers themselves (which are run as well),
+// and a run started by a signal can overlap with one at a normal exit
 func RunFinalizers() {
-	for _, f := range finalizers {
+	for index := 0; ; index++ {
+		finalizersLock.Lock()
+		if index >= len(finalizers) {
+			finalizersLock.Unlock()
+			return
+		}
+		f := finalizers[index]
+		finalizersLock.Unlock()
+
 		f.Run()
 	}
 }
 
 func AddFinalizer(f FinalizerFunc) {
+	finalizersLock.Lock()
+	defer finalizersLock.Unlock()
+
 	finalizers = append(finalizers, &finalizer{
 		function: f,
 		executed: false,
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Shared between all prefix writers, so lines from different hosts are never interleaved mid-line
+var outputLock sync.Mutex
+
+type PrefixWriter struct {
+	out    io.Writer
+	prefix string
+	buffer bytes.Buffer
+	lock   sync.Mutex
+}
+
+// Create a writer that writes each complete line to out, prefixed with "[prefix] "
+func NewPrefixWriter(out io.Writer, prefix string) *PrefixWriter {
+	return &PrefixWriter{
+		out:    out,
+		prefix: "[" + prefix + "] ",
+	}
+}
+
+func (w *PrefixWriter) Write(p []byte) (n int, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.buffer.Write(p)
+
+	for {
+		index := bytes.IndexByte(w.buffer.Bytes(), '\n')
+		if index < 0 {
+			break
+		}
+
+		line := w.buffer.Next(index + 1)
+		if err = w.writeLine(line); err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Write any remaining partial line, terminating it with a newline
+func (w *PrefixWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.buffer.Len() == 0 {
+		return nil
+	}
+
+	line := append(w.buffer.Bytes(), '\n')
+	w.buffer.Reset()
+
+	return w.writeLine(line)
+}
+
+func (w *PrefixWriter) writeLine(line []byte) error {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	_, err := w.out.Write(append([]byte(w.prefix), line...))
+	return err
+}